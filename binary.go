@@ -0,0 +1,264 @@
+package gpgsql
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ClarkQAQ/gpgsql/release"
+)
+
+var (
+	// bounds the download of a MirrorBinary without its own Client,
+	// NewRuntime calls Provide without a deadline
+	mirrorTimeout = 10 * time.Minute
+)
+
+// BinaryProvider supplies the postgres binaries of a runtime, as a
+// directory laid out like the release archive (bin, lib, share).
+type BinaryProvider interface {
+	// Provide returns the binary directory, cache is a writable
+	// directory the provider may keep extracted binaries in.
+	Provide(ctx context.Context, cache string) (string, error)
+}
+
+// EmbeddedBinary extracts an archive compiled into the program, each
+// version into its own cache directory. Versions besides the default
+// are embedded with the gpgsql_pg<major> build tags, the gpgsql_noembed
+// build tag leaves out every one.
+type EmbeddedBinary struct {
+	Version string // embedded version like 14.5.0 or 14, the default release when empty
+	Force   bool   // extract again even when the extracted binaries are intact
+}
+
+func (p *EmbeddedBinary) Provide(ctx context.Context, cache string) (string, error) {
+	r, e := p.release()
+	if e != nil {
+		return "", e
+	}
+
+	root := binaryRoot(cache, r.Version, r.Sha256)
+	return root, extractBinary(root, r.Archive, r.Sha256, p.Force)
+}
+
+// release looks up the embedded release of p.Version.
+func (p *EmbeddedBinary) release() (*release.Release, error) {
+	if !release.Embedded {
+		return nil, ErrNoEmbeddedArchive
+	}
+
+	version := p.Version
+	if version == "" {
+		version = release.Version
+	}
+
+	r := release.Lookup(version)
+	if r == nil {
+		return nil, fmt.Errorf("%w: %s, embedded are %s",
+			ErrVersionNotEmbedded, version, strings.Join(AvailableVersions(), ", "))
+	}
+
+	return r, nil
+}
+
+// releaseVersion saves running the binaries to learn their version.
+func (p *EmbeddedBinary) releaseVersion() string {
+	if r, e := p.release(); e == nil {
+		return r.Version
+	}
+
+	return ""
+}
+
+// ArchiveBinary extracts a local archive, either the .txz of the
+// release or the .jar of io.zonky.test.postgres holding one.
+type ArchiveBinary struct {
+	Path   string // archive file
+	Sha256 string // expected sha256 of the file, not checked when empty
+}
+
+func (p *ArchiveBinary) Provide(ctx context.Context, cache string) (string, error) {
+	b, e := os.ReadFile(p.Path)
+	if e != nil {
+		return "", fmt.Errorf("failed to read archive: %s", e.Error())
+	}
+
+	sum := sha256.Sum256(b)
+	if p.Sha256 != "" && !strings.EqualFold(p.Sha256, hex.EncodeToString(sum[:])) {
+		return "", ErrArchiveChecksum
+	}
+
+	return extractPackage(filepath.Join(cache, "archive_"+hex.EncodeToString(sum[:8])), b)
+}
+
+// SystemBinary uses an existing postgres installation as it is, e.g.
+// /usr/lib/postgresql/14 or a directory baked into a read-only image.
+// Nothing is ever written to it.
+type SystemBinary struct {
+	Dir string // installation directory holding bin
+}
+
+func (p *SystemBinary) Provide(ctx context.Context, cache string) (string, error) {
+	if _, e := os.Stat(filepath.Join(p.Dir, manifestFile)); e == nil {
+		if e := verifyBinary(p.Dir, "", false); e != nil {
+			return "", e
+		}
+	}
+
+	for _, name := range []string{release.PostgresBinary, release.InitdbBinary, release.PgCliBinary} {
+		if _, e := os.Stat(filepath.Join(p.Dir, name)); e != nil {
+			return "", fmt.Errorf("binary directory %s is incomplete: %s", p.Dir, e.Error())
+		}
+	}
+
+	return p.Dir, nil
+}
+
+// MirrorBinary downloads an archive, .txz or .jar like ArchiveBinary,
+// and keeps it extracted in the cache so it is downloaded only once.
+// The download must match the pinned Sha256.
+type MirrorBinary struct {
+	URL    string       // archive url
+	Sha256 string       // sha256 of the archive, required
+	Client *http.Client // a client giving up after 10 minutes by default
+}
+
+func (p *MirrorBinary) Provide(ctx context.Context, cache string) (string, error) {
+	if len(p.Sha256) != sha256.Size*2 {
+		return "", errors.New("mirror archive needs its sha256 pinned")
+	}
+
+	root := filepath.Join(cache, "mirror_"+strings.ToLower(p.Sha256[:16]))
+	if verifyBinary(root, "", false) == nil {
+		return root, nil
+	}
+
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: mirrorTimeout}
+	}
+
+	req, e := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+	if e != nil {
+		return "", e
+	}
+
+	res, e := client.Do(req)
+	if e != nil {
+		return "", fmt.Errorf("failed to download archive: %s", e.Error())
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download archive: %s", res.Status)
+	}
+
+	b, e := io.ReadAll(res.Body)
+	if e != nil {
+		return "", fmt.Errorf("failed to download archive: %s", e.Error())
+	}
+
+	if sum := sha256.Sum256(b); !strings.EqualFold(p.Sha256, hex.EncodeToString(sum[:])) {
+		return "", ErrArchiveChecksum
+	}
+
+	return extractPackage(root, b)
+}
+
+// extractPackage extracts the .txz in b, or in the .jar b, into root.
+func extractPackage(root string, b []byte) (string, error) {
+	txz, e := unpackJar(b)
+	if e != nil {
+		return "", e
+	}
+
+	sum := sha256.Sum256(txz)
+	return root, extractBinary(root, txz, hex.EncodeToString(sum[:]), false)
+}
+
+// unpackJar returns the .txz of a jar the way cmd/gen does, anything
+// that is not a zip is taken for the .txz itself.
+func unpackJar(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, []byte("PK\x03\x04")) {
+		return b, nil
+	}
+
+	r, e := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if e != nil {
+		return nil, fmt.Errorf("failed to open jar: %s", e.Error())
+	}
+
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || !strings.HasSuffix(f.Name, ".txz") {
+			continue
+		}
+
+		rc, e := f.Open()
+		if e != nil {
+			return nil, fmt.Errorf("failed to open %s: %s", f.Name, e.Error())
+		}
+		defer rc.Close()
+
+		return io.ReadAll(rc)
+	}
+
+	return nil, errors.New("no txz file found in jar")
+}
+
+// binaryVersion asks the postgres binary in dir for its version,
+// "postgres (PostgreSQL) 14.5 (Debian 14.5-1)" gives 14.5.
+func binaryVersion(dir string) (string, error) {
+	out, e := exec.Command(filepath.Join(dir, release.PostgresBinary), "-V").Output()
+	if e != nil {
+		return "", fmt.Errorf("failed to get postgres version: %s", e.Error())
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) < 3 {
+		return "", fmt.Errorf("unexpected postgres version: %q", out)
+	}
+
+	return fields[2], nil
+}
+
+// versionMatches reports whether version is want or one of its minor
+// releases, 14.5 matches 14, 14.5 and 14.5.0.
+func versionMatches(version, want string) bool {
+	have := strings.Split(version, ".")
+
+	for i, part := range strings.Split(want, ".") {
+		h := "0"
+		if i < len(have) {
+			h = have[i]
+		}
+
+		if part != h {
+			return false
+		}
+	}
+
+	return true
+}
+
+// majorVersion returns version the way PG_VERSION records it,
+// 9.6 before postgres 10 and 14 after.
+func majorVersion(version string) string {
+	parts := strings.SplitN(version, ".", 3)
+
+	if len(parts) > 1 && len(parts[0]) == 1 {
+		return parts[0] + "." + parts[1]
+	}
+
+	return parts[0]
+}
@@ -0,0 +1,224 @@
+package gpgsql
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	// bin/postgres and share/README, the layout of a release archive
+	testArchive = "testdata/postgres.txz"
+)
+
+func readTestArchive(t *testing.T) ([]byte, string) {
+	t.Helper()
+
+	b, e := os.ReadFile(testArchive)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	sum := sha256.Sum256(b)
+	return b, hex.EncodeToString(sum[:])
+}
+
+// testJar wraps txz the way io.zonky.test.postgres jars do.
+func testJar(t *testing.T, txz []byte) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+
+	for name, b := range map[string][]byte{
+		"META-INF/MANIFEST.MF":      []byte("Manifest-Version: 1.0\n"),
+		"postgres-linux-x86_64.txz": txz,
+	} {
+		f, e := w.Create(name)
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		if _, e := f.Write(b); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	if e := w.Close(); e != nil {
+		t.Fatal(e)
+	}
+
+	return buf.Bytes()
+}
+
+// checkExtracted fails t unless dir holds a complete, verified tree.
+func checkExtracted(t *testing.T, dir string) {
+	t.Helper()
+
+	if e := verifyBinary(dir, "", true); e != nil {
+		t.Fatal(e)
+	}
+
+	b, e := os.ReadFile(filepath.Join(dir, "share", "README"))
+	if e != nil || string(b) != "share\n" {
+		t.Fatalf("share/README holds %q: %v", b, e)
+	}
+}
+
+func TestArchiveBinary(t *testing.T) {
+	txz, sum := readTestArchive(t)
+
+	jar := filepath.Join(t.TempDir(), "postgres.jar")
+	if e := os.WriteFile(jar, testJar(t, txz), 0644); e != nil {
+		t.Fatal(e)
+	}
+
+	for _, c := range []struct {
+		name string
+		p    *ArchiveBinary
+	}{
+		{"txz", &ArchiveBinary{Path: testArchive, Sha256: sum}},
+		{"txz unpinned", &ArchiveBinary{Path: testArchive}},
+		{"jar", &ArchiveBinary{Path: jar}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cache := t.TempDir()
+
+			dir, e := c.p.Provide(context.Background(), cache)
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			if filepath.Dir(dir) != cache {
+				t.Fatalf("extracted to %s, outside the cache %s", dir, cache)
+			}
+
+			checkExtracted(t, dir)
+		})
+	}
+
+	p := &ArchiveBinary{Path: testArchive, Sha256: strings.Repeat("0", 64)}
+
+	if _, e := p.Provide(context.Background(), t.TempDir()); !errors.Is(e, ErrArchiveChecksum) {
+		t.Fatalf("got %v, want %v", e, ErrArchiveChecksum)
+	}
+}
+
+func TestMirrorBinary(t *testing.T) {
+	txz, sum := readTestArchive(t)
+	jar := testJar(t, txz)
+	jarSum := sha256.Sum256(jar)
+
+	var hits atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+
+		switch r.URL.Path {
+		case "/postgres.txz":
+			w.Write(txz)
+		case "/postgres.jar":
+			w.Write(jar)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	for _, c := range []struct {
+		name string
+		p    *MirrorBinary
+	}{
+		{"txz", &MirrorBinary{URL: server.URL + "/postgres.txz", Sha256: sum, Client: server.Client()}},
+		{"jar", &MirrorBinary{URL: server.URL + "/postgres.jar", Sha256: hex.EncodeToString(jarSum[:])}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cache := t.TempDir()
+			hits.Store(0)
+
+			dir, e := c.p.Provide(context.Background(), cache)
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			checkExtracted(t, dir)
+
+			// the cached tree is used without downloading again
+			again, e := c.p.Provide(context.Background(), cache)
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			if again != dir || hits.Load() != 1 {
+				t.Fatalf("second Provide gave %s after %d downloads, want %s after 1", again, hits.Load(), dir)
+			}
+		})
+	}
+
+	t.Run("checksum", func(t *testing.T) {
+		p := &MirrorBinary{URL: server.URL + "/postgres.jar", Sha256: sum}
+
+		if _, e := p.Provide(context.Background(), t.TempDir()); !errors.Is(e, ErrArchiveChecksum) {
+			t.Fatalf("got %v, want %v", e, ErrArchiveChecksum)
+		}
+	})
+
+	t.Run("status", func(t *testing.T) {
+		p := &MirrorBinary{URL: server.URL + "/missing.txz", Sha256: sum}
+
+		if _, e := p.Provide(context.Background(), t.TempDir()); e == nil || !strings.Contains(e.Error(), "404") {
+			t.Fatalf("got %v, want a 404 error", e)
+		}
+	})
+
+	t.Run("stalled", func(t *testing.T) {
+		timeout := mirrorTimeout
+		mirrorTimeout = 200 * time.Millisecond
+		defer func() { mirrorTimeout = timeout }()
+
+		stalled := make(chan struct{})
+
+		stall := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+
+			select {
+			case <-stalled:
+			case <-r.Context().Done():
+			}
+		}))
+		defer stall.Close()
+		defer close(stalled)
+
+		p := &MirrorBinary{URL: stall.URL + "/postgres.txz", Sha256: sum}
+
+		start := time.Now()
+
+		if _, e := p.Provide(context.Background(), t.TempDir()); e == nil {
+			t.Fatal("no error for a stalled download")
+		}
+
+		if d := time.Since(start); d > 10*time.Second {
+			t.Fatalf("stalled download gave up after %s", d)
+		}
+	})
+
+	t.Run("unpinned", func(t *testing.T) {
+		p := &MirrorBinary{URL: server.URL + "/postgres.txz"}
+
+		if _, e := p.Provide(context.Background(), t.TempDir()); e == nil {
+			t.Fatal("no error without a pinned sha256")
+		}
+	})
+}
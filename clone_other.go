@@ -0,0 +1,13 @@
+//go:build !linux
+
+package gpgsql
+
+import (
+	"errors"
+	"os"
+)
+
+// cloneFile makes dst a copy-on-write clone of src.
+func cloneFile(dst, src *os.File) error {
+	return errors.New("file cloning is not supported")
+}
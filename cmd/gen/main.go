@@ -11,6 +11,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"utilware/dep/fasttemplate"
 
@@ -91,8 +92,15 @@ var (
 
 	proxyAddr = "" // i'm in china, so need a proxy...
 
+	// postgres versions to embed, the first is the default one
+	versions []string
+
 	//go:embed postgres.tmpl
 	postgresTmpl string
+
+	// further versions, behind the gpgsql_pg<major> build tag
+	//go:embed postgres_version.tmpl
+	postgresVersionTmpl string
 )
 
 type MavenMetadata struct {
@@ -100,8 +108,11 @@ type MavenMetadata struct {
 	Text       string   `xml:",chardata"`
 	ArtifactId string   `xml:"artifactId"`
 	Versioning struct {
-		Text    string `xml:",chardata"`
-		Release string `xml:"release"`
+		Text     string `xml:",chardata"`
+		Release  string `xml:"release"`
+		Versions struct {
+			Version []string `xml:"version"`
+		} `xml:"versions"`
 	} `xml:"versioning"`
 }
 
@@ -118,17 +129,37 @@ type ReleaseArchiveInfo struct {
 }
 
 func main() {
+	versionList := ""
+
 	flag.StringVar(&proxyAddr, "proxy", "", "proxy address")
+	flag.StringVar(&versionList, "versions", "", "comma separated postgres versions to embed, the first is the default, the latest release by default")
 	flag.Parse()
 
+	for _, v := range strings.Split(versionList, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			versions = append(versions, v)
+		}
+	}
+
 	postgresTemplate, e := fasttemplate.NewTemplate(postgresTmpl, "{{", "}}")
 	if e != nil {
 		logger.Fatal("new template failed: %s", e.Error())
 	}
 
-	if f, _ := os.Stat(releaseDirName); f != nil && f.IsDir() {
-		if e := os.RemoveAll(releaseDirName); e != nil {
-			logger.Fatal("remove release directory failed: %s", e.Error())
+	postgresVersionTemplate, e := fasttemplate.NewTemplate(postgresVersionTmpl, "{{", "}}")
+	if e != nil {
+		logger.Fatal("new template failed: %s", e.Error())
+	}
+
+	// keep the hand written files, e.g. the gpgsql_noembed ones
+	generated, e := filepath.Glob(filepath.Join(releaseDirName, "postgres-*"))
+	if e != nil {
+		logger.Fatal("list release directory failed: %s", e.Error())
+	}
+
+	for _, name := range generated {
+		if e := os.Remove(name); e != nil {
+			logger.Fatal("remove release file failed: %s", e.Error())
 		}
 	}
 
@@ -138,39 +169,83 @@ func main() {
 
 	for target, archs := range supportedTargets {
 		for _, arch := range archs {
-			getArchArchive(target, arch, postgresTemplate)
+			getArchArchives(target, arch, postgresTemplate, postgresVersionTemplate)
 		}
 	}
 
 	logger.Info("plase run 'gofmt -w release/' to format generated files")
 }
 
-func getArchArchive(target string, arch string, postgresTemplate *fasttemplate.Template) {
+// getArchArchives writes the default version and the further ones
+// available for target and arch, the latest release stands in for an
+// unavailable default.
+func getArchArchives(target, arch string, postgresTemplate, postgresVersionTemplate *fasttemplate.Template) {
 	metadata, e := getMetadata(target, arch)
 	if e != nil {
 		logger.Fatal("target: %s, arch: %s get metadata failed: %s", target, arch, e.Error())
 	}
 
-	logger.Debug("target: %s, arch: %s, release: %s", target, arch, metadata.Versioning.Release)
-	logger.Debug("download url: %s", fmt.Sprintf(repositoryBinaryURL, target, arch, metadata.Versioning.Release))
+	available := map[string]bool{}
+	for _, v := range metadata.Versioning.Versions.Version {
+		available[v] = true
+	}
+
+	version := metadata.Versioning.Release
 
-	b, e := getArchive(target, arch, metadata.Versioning.Release)
+	if len(versions) > 0 {
+		if available[versions[0]] {
+			version = versions[0]
+		} else {
+			logger.Info("target: %s, arch: %s has no release %s, using %s",
+				target, arch, versions[0], version)
+		}
+	}
+
+	getArchArchive(target, arch, version, postgresTemplate)
+
+	for i := 1; i < len(versions); i++ {
+		if versions[i] == version {
+			continue
+		}
+
+		if !available[versions[i]] {
+			logger.Info("target: %s, arch: %s has no release %s, skipped", target, arch, versions[i])
+			continue
+		}
+
+		getArchArchive(target, arch, versions[i], postgresVersionTemplate)
+	}
+}
+
+func getArchArchive(target, arch, version string, postgresTemplate *fasttemplate.Template) {
+	logger.Debug("target: %s, arch: %s, release: %s", target, arch, version)
+	logger.Debug("download url: %s", fmt.Sprintf(repositoryBinaryURL, target, arch, version))
+
+	b, e := getArchive(target, arch, version)
 	if e != nil {
 		logger.Fatal("target: %s, arch: %s, release: %s get archive failed: %s",
-			target, arch, metadata.Versioning.Release, e.Error())
+			target, arch, version, e.Error())
 	}
 
-	fileName := fmt.Sprintf(releaseFileName, target, arch, metadata.Versioning.Release, "tar.xz")
+	fileName := fmt.Sprintf(releaseFileName, target, arch, version, "tar.xz")
 	if e := os.WriteFile(filepath.Join(releaseDirName, fileName), b, os.ModePerm); e != nil {
 		logger.Fatal("target: %s, arch: %s, release: %s write archive failed: %s",
-			target, arch, metadata.Versioning.Release, e.Error())
+			target, arch, version, e.Error())
+	}
+
+	major, _, _ := strings.Cut(version, ".")
+	if n, _ := strconv.Atoi(major); n < 10 {
+		// 9.6 and older count the second number as major
+		major = strings.Join(strings.SplitN(version, ".", 3)[:2], "_")
 	}
 
 	data := map[string]string{
 		"target":  target,
 		"arch":    arch,
-		"version": metadata.Versioning.Release,
+		"version": version,
 		"sha256":  fmt.Sprintf("%x", sha256.Sum256(b)),
+		"major":   major,
+		"ident":   strings.ReplaceAll(version, ".", "_"),
 	}
 
 	postgresGo := postgresTemplate.ExecuteFuncString(func(w io.Writer, tag string) (int, error) {
@@ -188,14 +263,14 @@ func getArchArchive(target string, arch string, postgresTemplate *fasttemplate.T
 	})
 
 	if e := os.WriteFile(filepath.Join(releaseDirName,
-		fmt.Sprintf(releaseFileName, target, arch, metadata.Versioning.Release, "go")),
+		fmt.Sprintf(releaseFileName, target, arch, version, "go")),
 		[]byte(postgresGo), os.ModePerm); e != nil {
 		logger.Fatal("target: %s, arch: %s, release: %s write postgres.go failed: %s",
-			target, arch, metadata.Versioning.Release, e.Error())
+			target, arch, version, e.Error())
 	}
 
 	logger.Info("target: %s, arch: %s, release: %s write archive success",
-		target, arch, metadata.Versioning.Release)
+		target, arch, version)
 }
 
 // translate system target and architecture
@@ -0,0 +1,322 @@
+package gpgsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// database every cluster has, used for administrative statements
+	maintenanceDatabase = "postgres"
+
+	// NAMEDATALEN - 1
+	maxIdentifierLength = 63
+
+	// comment marking template databases and their version
+	templateComment = "gpgsql template %s"
+
+	// clones are named <template>_clone_<pid>_<seq>
+	cloneInfix = "_clone_"
+)
+
+var (
+	defaultDatabaseTemplateOptions = &DatabaseTemplateOptions{
+		PoolSize: 2,
+	}
+)
+
+type DatabaseTemplateOptions struct {
+	Migrate  func(ctx context.Context, db *sql.DB) error // fills the template, runs only when it is (re)created
+	Version  string                                      // template is recreated when this changes, e.g. a migration checksum
+	PoolSize int                                         // clones created ahead of time, 0 disables the pool
+}
+
+// execer is satisfied by *sql.DB and *sql.Conn.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// DatabaseTemplate is a migrated database that isolated clones are
+// created from with CREATE DATABASE ... TEMPLATE.
+type DatabaseTemplate struct {
+	g    *GpgsqlRuntime
+	name string
+	opt  *DatabaseTemplateOptions
+	seq  uint64
+
+	pool      chan string
+	closed    chan struct{}
+	closeOnce sync.Once
+	filler    sync.WaitGroup
+}
+
+// DatabaseTemplate creates the template database name by running
+// Migrate on it, or reuses it when it exists with the same Version,
+// and starts filling the pool of clones in the background. Clones left
+// behind by processes that died are dropped first.
+func (g *GpgsqlRuntime) DatabaseTemplate(ctx context.Context, name string, opts ...*DatabaseTemplateOptions) (*DatabaseTemplate, error) {
+	if len(opts) < 1 || opts[0] == nil {
+		opts = append(opts[:0], defaultDatabaseTemplateOptions)
+	}
+
+	opt := opts[0]
+
+	if name == "" || len(name) > maxIdentifierLength-30 {
+		return nil, fmt.Errorf("invalid template name %q", name)
+	}
+
+	db, e := g.DB(maintenanceDatabase)
+	if e != nil {
+		return nil, e
+	}
+	defer db.Close()
+
+	admin, e := db.Conn(ctx)
+	if e != nil {
+		return nil, fmt.Errorf("failed to connect: %s", e.Error())
+	}
+	defer admin.Close()
+
+	// processes sharing a server create the same template only once
+	if _, e := admin.ExecContext(ctx, "SELECT pg_advisory_lock(hashtext($1))", name); e != nil {
+		return nil, fmt.Errorf("failed to lock template: %s", e.Error())
+	}
+	defer admin.ExecContext(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", name)
+
+	sweepClones(ctx, admin, name)
+
+	var comment sql.NullString
+
+	e = admin.QueryRowContext(ctx, `SELECT shobj_description(oid, 'pg_database')
+		FROM pg_database WHERE datname = $1 AND datistemplate`, name).Scan(&comment)
+
+	switch {
+	case errors.Is(e, sql.ErrNoRows):
+		if e := g.createTemplate(ctx, admin, name, opt); e != nil {
+			return nil, e
+		}
+	case e != nil:
+		return nil, fmt.Errorf("failed to look up template: %s", e.Error())
+	case comment.String != fmt.Sprintf(templateComment, opt.Version):
+		if e := dropTemplate(ctx, admin, name); e != nil {
+			return nil, e
+		}
+
+		if e := g.createTemplate(ctx, admin, name, opt); e != nil {
+			return nil, e
+		}
+	}
+
+	t := &DatabaseTemplate{
+		g:      g,
+		name:   name,
+		opt:    opt,
+		closed: make(chan struct{}),
+	}
+
+	if opt.PoolSize > 0 {
+		t.pool = make(chan string, opt.PoolSize)
+		t.filler.Add(1)
+		go t.fill()
+	}
+
+	return t, nil
+}
+
+// createTemplate creates and migrates the template, then locks it
+// against connections so clones can always be created from it.
+func (g *GpgsqlRuntime) createTemplate(ctx context.Context, admin execer, name string, opt *DatabaseTemplateOptions) error {
+	ident := pq.QuoteIdentifier(name)
+
+	// a half migrated template of an earlier failure
+	if _, e := admin.ExecContext(ctx, "DROP DATABASE IF EXISTS "+ident); e != nil {
+		return fmt.Errorf("failed to drop template: %s", e.Error())
+	}
+
+	if _, e := admin.ExecContext(ctx, "CREATE DATABASE "+ident); e != nil {
+		return fmt.Errorf("failed to create template: %s", e.Error())
+	}
+
+	if opt.Migrate != nil {
+		db, e := g.DB(name)
+		if e != nil {
+			return e
+		}
+
+		e = opt.Migrate(ctx, db)
+		db.Close()
+
+		if e != nil {
+			return fmt.Errorf("failed to migrate template: %w", e)
+		}
+	}
+
+	for _, stmt := range []string{
+		"COMMENT ON DATABASE " + ident + " IS " + pq.QuoteLiteral(fmt.Sprintf(templateComment, opt.Version)),
+		"ALTER DATABASE " + ident + " WITH IS_TEMPLATE true ALLOW_CONNECTIONS false",
+	} {
+		if _, e := admin.ExecContext(ctx, stmt); e != nil {
+			return fmt.Errorf("failed to mark template: %s", e.Error())
+		}
+	}
+
+	return nil
+}
+
+func dropTemplate(ctx context.Context, admin execer, name string) error {
+	ident := pq.QuoteIdentifier(name)
+
+	if _, e := admin.ExecContext(ctx, "ALTER DATABASE "+ident+" WITH IS_TEMPLATE false"); e != nil {
+		return fmt.Errorf("failed to unmark template: %s", e.Error())
+	}
+
+	return dropDatabase(ctx, admin, name)
+}
+
+// dropDatabase disconnects every session of name and drops it.
+func dropDatabase(ctx context.Context, admin execer, name string) error {
+	if _, e := admin.ExecContext(ctx, `SELECT pg_terminate_backend(pid)
+		FROM pg_stat_activity WHERE datname = $1 AND pid <> pg_backend_pid()`, name); e != nil {
+		return fmt.Errorf("failed to disconnect %s: %s", name, e.Error())
+	}
+
+	if _, e := admin.ExecContext(ctx, "DROP DATABASE IF EXISTS "+pq.QuoteIdentifier(name)); e != nil {
+		return fmt.Errorf("failed to drop %s: %s", name, e.Error())
+	}
+
+	return nil
+}
+
+// sweepClones drops the clones of the template name whose owner
+// process is gone, like sweepEphemeral does for data directories. The
+// processes sharing a server run on its machine, a dead pid means
+// nobody drops the clone anymore.
+func sweepClones(ctx context.Context, admin *sql.Conn, name string) {
+	prefix := name + cloneInfix
+
+	rows, e := admin.QueryContext(ctx, "SELECT datname FROM pg_database WHERE left(datname, length($1)) = $1", prefix)
+	if e != nil {
+		return
+	}
+
+	stale := []string{}
+
+	for rows.Next() {
+		var clone string
+		if e := rows.Scan(&clone); e != nil {
+			break
+		}
+
+		owner, _, _ := strings.Cut(strings.TrimPrefix(clone, prefix), "_")
+
+		pid, e := strconv.Atoi(owner)
+		if e != nil || pid == os.Getpid() || processAlive(pid) {
+			continue
+		}
+
+		stale = append(stale, clone)
+	}
+
+	rows.Close()
+
+	for _, clone := range stale {
+		dropDatabase(ctx, admin, clone)
+	}
+}
+
+// fill keeps the pool topped up with fresh clones until Close.
+func (t *DatabaseTemplate) fill() {
+	defer t.filler.Done()
+
+	for {
+		name, e := t.create(context.Background())
+		if e != nil {
+			// Clone creates its own clones while the pool is broken
+			return
+		}
+
+		select {
+		case t.pool <- name:
+		case <-t.closed:
+			t.drop(context.Background(), name)
+			return
+		}
+	}
+}
+
+// create makes a new uniquely named clone of the template.
+func (t *DatabaseTemplate) create(ctx context.Context) (string, error) {
+	name := fmt.Sprintf("%s%s%d_%d", t.name, cloneInfix, os.Getpid(), atomic.AddUint64(&t.seq, 1))
+
+	admin, e := t.g.DB(maintenanceDatabase)
+	if e != nil {
+		return "", e
+	}
+	defer admin.Close()
+
+	if _, e := admin.ExecContext(ctx, fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s",
+		pq.QuoteIdentifier(name), pq.QuoteIdentifier(t.name))); e != nil {
+		return "", fmt.Errorf("failed to clone template: %s", e.Error())
+	}
+
+	return name, nil
+}
+
+func (t *DatabaseTemplate) drop(ctx context.Context, name string) error {
+	admin, e := t.g.DB(maintenanceDatabase)
+	if e != nil {
+		return e
+	}
+	defer admin.Close()
+
+	return dropDatabase(ctx, admin, name)
+}
+
+// Clone returns the name of a new database with the content of the
+// template, taken from the pool when one is ready.
+func (t *DatabaseTemplate) Clone(ctx context.Context) (string, error) {
+	select {
+	case name := <-t.pool:
+		return name, nil
+	default:
+	}
+
+	return t.create(ctx)
+}
+
+// Drop drops a database returned by Clone.
+func (t *DatabaseTemplate) Drop(ctx context.Context, name string) error {
+	return t.drop(ctx, name)
+}
+
+// Name returns the name of the template database.
+func (t *DatabaseTemplate) Name() string {
+	return t.name
+}
+
+// Close stops filling the pool and drops the clones nobody took,
+// the template itself is kept for the next run.
+func (t *DatabaseTemplate) Close(ctx context.Context) (e error) {
+	t.closeOnce.Do(func() { close(t.closed) })
+	t.filler.Wait()
+
+	for {
+		select {
+		case name := <-t.pool:
+			if de := t.drop(ctx, name); de != nil && e == nil {
+				e = de
+			}
+		default:
+			return e
+		}
+	}
+}
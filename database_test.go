@@ -0,0 +1,234 @@
+package gpgsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// databases returns the databases whose names start with prefix.
+func databases(t *testing.T, g *GpgsqlRuntime, prefix string) []string {
+	t.Helper()
+
+	db, e := g.DB(maintenanceDatabase)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer db.Close()
+
+	rows, e := db.Query("SELECT datname FROM pg_database WHERE left(datname, length($1)) = $1 ORDER BY 1", prefix)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer rows.Close()
+
+	names := []string{}
+
+	for rows.Next() {
+		var name string
+		if e := rows.Scan(&name); e != nil {
+			t.Fatal(e)
+		}
+
+		names = append(names, name)
+	}
+
+	if e := rows.Err(); e != nil {
+		t.Fatal(e)
+	}
+
+	return names
+}
+
+// waitPool waits until the pool of tmpl holds n clones.
+func waitPool(t *testing.T, tmpl *DatabaseTemplate, n int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(30 * time.Second); len(tmpl.pool) < n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool holds %d clones, want %d", len(tmpl.pool), n)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDatabaseTemplate(t *testing.T) {
+	g := testServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	migrations := 0
+
+	opt := &DatabaseTemplateOptions{
+		Version:  "1",
+		PoolSize: 2,
+		Migrate: func(ctx context.Context, db *sql.DB) error {
+			migrations++
+
+			_, e := db.ExecContext(ctx, "CREATE TABLE t (id int PRIMARY KEY); INSERT INTO t VALUES (1)")
+			return e
+		},
+	}
+
+	tmpl, e := g.DatabaseTemplate(ctx, "tmpl", opt)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	waitPool(t, tmpl, 2)
+
+	names := map[string]bool{}
+	dbs := []*sql.DB{}
+
+	// two from the pool, one created while it refills
+	for n := 0; n < 3; n++ {
+		name, e := tmpl.Clone(ctx)
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		if names[name] || name == tmpl.Name() {
+			t.Fatalf("clone name %s handed out twice", name)
+		}
+
+		names[name] = true
+
+		db, e := g.DB(name)
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer db.Close()
+
+		dbs = append(dbs, db)
+	}
+
+	waitPool(t, tmpl, 2)
+
+	if _, e := dbs[0].Exec("INSERT INTO t VALUES (2)"); e != nil {
+		t.Fatal(e)
+	}
+
+	if n := countRows(t, dbs[0]); n != 2 {
+		t.Fatalf("%d rows in the changed clone, want 2", n)
+	}
+
+	// clones don't see each other
+	if n := countRows(t, dbs[1]); n != 1 {
+		t.Fatalf("%d rows in another clone, want 1", n)
+	}
+
+	for name := range names {
+		if e := tmpl.Drop(ctx, name); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	if e := tmpl.Close(ctx); e != nil {
+		t.Fatal(e)
+	}
+
+	// Drop removed the clones taken, Close the ones in the pool
+	if left := databases(t, g, "tmpl_"); len(left) > 0 {
+		t.Fatalf("clones left: %q", left)
+	}
+
+	// the same version reuses the template, another one migrates again
+	for _, c := range []struct {
+		version    string
+		migrations int
+	}{
+		{"1", 1},
+		{"2", 2},
+	} {
+		tmpl, e := g.DatabaseTemplate(ctx, "tmpl", &DatabaseTemplateOptions{Version: c.version, Migrate: opt.Migrate})
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		if migrations != c.migrations {
+			t.Fatalf("version %s: %d migrations, want %d", c.version, migrations, c.migrations)
+		}
+
+		name, e := tmpl.Clone(ctx)
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		db, e := g.DB(name)
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		if n := countRows(t, db); n != 1 {
+			t.Fatalf("%d rows in a clone, want 1", n)
+		}
+
+		db.Close()
+
+		if e := tmpl.Drop(ctx, name); e != nil {
+			t.Fatal(e)
+		}
+
+		if e := tmpl.Close(ctx); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	if _, e := g.DatabaseTemplate(ctx, ""); e == nil {
+		t.Fatal("no error for an empty template name")
+	}
+}
+
+// clones of processes that died before dropping them are dropped when
+// the template is opened again
+func TestDatabaseTemplateSweepClones(t *testing.T) {
+	g := testServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tmpl, e := g.DatabaseTemplate(ctx, "sweep", &DatabaseTemplateOptions{})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	stale := fmt.Sprintf("sweep%s%d_1", cloneInfix, deadPid(t))
+	own := fmt.Sprintf("sweep%s%d_99", cloneInfix, os.Getpid())
+	live := fmt.Sprintf("sweep%s%d_1", cloneInfix, os.Getppid())
+
+	db, e := g.DB(maintenanceDatabase)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer db.Close()
+
+	for _, name := range []string{stale, own, live, "sweep_other"} {
+		if _, e := db.ExecContext(ctx, "CREATE DATABASE "+pq.QuoteIdentifier(name)+" TEMPLATE sweep"); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	tmpl.Close(ctx)
+
+	tmpl, e = g.DatabaseTemplate(ctx, "sweep", &DatabaseTemplateOptions{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer tmpl.Close(ctx)
+
+	want := []string{"sweep", live, own, "sweep_other"}
+	sort.Strings(want)
+
+	if got := databases(t, g, "sweep"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("databases %q after the sweep, want %q", got, want)
+	}
+}
@@ -3,113 +3,456 @@ package gpgsql
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ClarkQAQ/gpgsql/release"
 
 	"github.com/xi2/xz"
 )
 
-var (
-	binaryRootPath string = func() string {
-		base, _ := os.UserCacheDir()
+const (
+	CacheDirEnv  = "GPGSQL_CACHE_DIR"  // overrides the cache directory of binaries, templates and shared servers
+	BinaryDirEnv = "GPGSQL_BINARY_DIR" // pre-extracted binaries used read-only, nothing is extracted
 
-		if strings.TrimSpace(base) == "" {
-			base = os.TempDir()
-		}
+	// written last, a tree without it was not extracted completely
+	manifestFile = ".gpgsql-manifest.json"
 
-		return filepath.Join(base, "gpgsql",
-			fmt.Sprintf("%s_%s", release.Version, release.Sha256[:8]))
-	}()
+	// siblings of the binary root, being extracted or replaced
+	binaryTempInfix = ".tmp-"
+	binaryOldInfix  = ".old-"
+
+	// replaced trees are kept this long for servers still running from them
+	oldBinaryGrace = 24 * time.Hour
 )
 
+var (
+	ErrArchiveChecksum    = errors.New("archive does not match its checksum")
+	ErrBinaryDamaged      = errors.New("extracted binaries are damaged")
+	ErrNoEmbeddedArchive  = errors.New("built with gpgsql_noembed, no embedded archive")
+	ErrVersionNotEmbedded = errors.New("postgres version is not embedded")
+)
+
+// cacheRoot returns $GPGSQL_CACHE_DIR, or the gpgsql directory in
+// the user cache directory.
+func cacheRoot() string {
+	if dir := strings.TrimSpace(os.Getenv(CacheDirEnv)); dir != "" {
+		return dir
+	}
+
+	base, _ := os.UserCacheDir()
+
+	if strings.TrimSpace(base) == "" {
+		base = os.TempDir()
+	}
+
+	return filepath.Join(base, "gpgsql")
+}
+
+// binaryRoot is where the embedded archive of version is extracted in
+// cache, every version has its own.
+func binaryRoot(cache, version, sum string) string {
+	if len(sum) < 8 {
+		return filepath.Join(cache, "noembed")
+	}
+
+	return filepath.Join(cache, fmt.Sprintf("%s_%s", version, sum[:8]))
+}
+
+// defaultBinaryRoot is where the default release is extracted in the
+// cache of cacheRoot, resolved on every call like NewRuntime does.
+func defaultBinaryRoot() string {
+	return binaryRoot(cacheRoot(), release.Version, release.Sha256)
+}
+
+type binaryManifest struct {
+	Archive string          `json:"archive"` // sha256 of the extracted archive
+	Files   []manifestEntry `json:"files"`
+}
+
+type manifestEntry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Sha256  string    `json:"sha256,omitempty"`
+	Link    string    `json:"link,omitempty"`
+}
+
+// DecompressBinary extracts the embedded archive into the default cache,
+// $GPGSQL_CACHE_DIR at the time of the call, unless a complete,
+// undamaged tree of it exists already, see VerifyBinary. The archive
+// is checked against release.Sha256 before anything is extracted.
+// Processes extracting at the same time take turns on a lock file, the
+// tree is unpacked next to its final place and renamed into it, so no
+// process ever sees a partial tree. A replaced tree is moved aside
+// instead of removed, servers started from it keep working.
 // form https://github.com/fergusstrange/embedded-postgres/blob/master/decompression.go#L23
 func DecompressBinary(force bool) error {
-	xzReader, e := xz.NewReader(bytes.NewReader(release.Archive), 0)
+	return decompressBinary(defaultBinaryRoot(), force)
+}
+
+func decompressBinary(root string, force bool) error {
+	if !release.Embedded {
+		return ErrNoEmbeddedArchive
+	}
+
+	return extractBinary(root, release.Archive, release.Sha256, force)
+}
+
+// extractBinary extracts the tar.xz archive whose sha256 is sum into
+// root, unless root holds an undamaged tree of it already.
+func extractBinary(root string, archive []byte, sum string, force bool) error {
+	if !force && verifyBinary(root, sum, false) == nil {
+		return nil
+	}
+
+	parent := filepath.Dir(root)
+
+	if e := os.MkdirAll(parent, os.ModePerm); e != nil {
+		return fmt.Errorf("create binary parent path failed: %s", e.Error())
+	}
+
+	lock, e := lockFile(root + ".lock")
 	if e != nil {
-		return fmt.Errorf("decompress archive failed: %s", e.Error())
+		return e
 	}
+	defer lock.Unlock()
 
-	if f, _ := os.Stat(binaryRootPath); (f != nil && f.IsDir()) && !force {
+	// another process may have extracted it while we waited
+	if !force && verifyBinary(root, sum, false) == nil {
 		return nil
 	}
 
-	if e := os.RemoveAll(binaryRootPath); e != nil {
-		return fmt.Errorf("remove binary root path failed: %s", e.Error())
+	sweepBinary(root)
+
+	if h := sha256.Sum256(archive); hex.EncodeToString(h[:]) != sum {
+		return ErrArchiveChecksum
 	}
 
-	if e := os.MkdirAll(binaryRootPath, os.ModePerm); e != nil {
+	tmp, e := os.MkdirTemp(parent, filepath.Base(root)+binaryTempInfix+"*")
+	if e != nil {
 		return fmt.Errorf("create temp dir failed: %s", e.Error())
 	}
 
-	tarReader := tar.NewReader(xzReader)
+	defer os.RemoveAll(tmp)
+
+	// MkdirTemp is private to the owner, the tree never was
+	if e := os.Chmod(tmp, 0755); e != nil {
+		return e
+	}
+
+	if e := extractArchive(tmp, archive, sum); e != nil {
+		return e
+	}
+
+	if f, _ := os.Lstat(root); f != nil {
+		old := fmt.Sprintf("%s%s%d", root, binaryOldInfix, time.Now().UnixNano())
+
+		if e := os.Rename(root, old); e != nil {
+			return fmt.Errorf("move old binary root path aside failed: %s", e.Error())
+		}
+	}
+
+	if e := os.Rename(tmp, root); e != nil {
+		return fmt.Errorf("move binary root path into place failed: %s", e.Error())
+	}
+
+	return nil
+}
+
+// extractArchive unpacks archive into dir and writes the manifest
+// once everything is in place.
+func extractArchive(dir string, archive []byte, sum string) error {
+	xzReader, e := xz.NewReader(bytes.NewReader(archive), 0)
+	if e != nil {
+		return fmt.Errorf("decompress archive failed: %s", e.Error())
+	}
+
+	return extractTar(dir, xzReader, sum)
+}
+
+// extractTar extracts the tar stream r into dir and writes its manifest,
+// entries leaving dir are rejected, see archiveEntryPath.
+func extractTar(dir string, r io.Reader, sum string) error {
+	tarReader := tar.NewReader(r)
+	manifest := &binaryManifest{Archive: sum}
+
+	// symlinks created by this archive, nothing is written through them
+	links := make(map[string]bool)
 
 	for {
 		header, e := tarReader.Next()
 
 		if errors.Is(e, io.EOF) {
-			return nil
+			return writeManifest(dir, manifest)
 		}
 
 		if e != nil {
 			return fmt.Errorf("read archive header failed: %s", e.Error())
 		}
 
-		targetPath := filepath.Join(binaryRootPath, header.Name)
+		name, e := archiveEntryPath(header, links)
+		if e != nil {
+			return e
+		}
+
+		targetPath := filepath.Join(dir, name)
 
 		if e := os.MkdirAll(filepath.Dir(targetPath), os.ModePerm); e != nil {
 			return fmt.Errorf("create directory failed: %s", e.Error())
 		}
 
-		if e := exportBinary(header, targetPath, tarReader); e != nil {
+		h := sha256.New()
+
+		if e := exportBinary(header, targetPath, io.TeeReader(tarReader, h)); e != nil {
 			return e
 		}
-	}
-}
 
-func exportBinary(header *tar.Header, targetPath string, tarReader *tar.Reader) error {
-	if e := func() (e error) {
 		switch header.Typeflag {
 		case tar.TypeReg:
-			outFile, e := os.OpenFile(targetPath, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
+			info, e := os.Stat(targetPath)
 			if e != nil {
-				return fmt.Errorf("create file failed: %s", e.Error())
+				return fmt.Errorf("stat file failed: %s", e.Error())
 			}
 
-			defer func() {
-				if e = outFile.Close(); e != nil {
-					e = fmt.Errorf("close file failed: %s", e.Error())
-				}
-			}()
-
-			if _, e = io.Copy(outFile, tarReader); e != nil {
-				return fmt.Errorf("write file failed: %s", e.Error())
-			}
+			manifest.Files = append(manifest.Files, manifestEntry{
+				Path:    header.Name,
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+				Sha256:  hex.EncodeToString(h.Sum(nil)),
+			})
 		case tar.TypeSymlink:
-			if e = os.RemoveAll(targetPath); e != nil {
-				return fmt.Errorf("remove symlink failed: %s", e.Error())
-			}
+			links[name] = true
 
-			if e = os.Symlink(header.Linkname, targetPath); e != nil {
-				return fmt.Errorf("create symlink failed: %s", e.Error())
-			}
+			manifest.Files = append(manifest.Files, manifestEntry{
+				Path: header.Name,
+				Link: header.Linkname,
+			})
+		}
+	}
+}
+
+// archiveEntryPath returns the cleaned path of header relative to the
+// extraction directory. It rejects absolute names, names and symlink
+// targets leaving the directory and names below or replacing a symlink
+// in links, so that nothing is written through a symlink of the archive.
+func archiveEntryPath(header *tar.Header, links map[string]bool) (string, error) {
+	name := filepath.Clean(filepath.FromSlash(header.Name))
+
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("archive entry %q leaves the binary directory", header.Name)
+	}
+
+	for parent := filepath.Dir(name); parent != "."; parent = filepath.Dir(parent) {
+		if links[parent] {
+			return "", fmt.Errorf("archive entry %q goes through symlink %q", header.Name, filepath.ToSlash(parent))
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeSymlink:
+		link := filepath.FromSlash(header.Linkname)
+
+		if filepath.IsAbs(link) || !filepath.IsLocal(filepath.Join(filepath.Dir(name), link)) {
+			return "", fmt.Errorf("archive symlink %q to %q leaves the binary directory", header.Name, header.Linkname)
+		}
+	case tar.TypeReg:
+		if links[name] {
+			return "", fmt.Errorf("archive entry %q goes through symlink %q", header.Name, header.Name)
+		}
+	}
+
+	return name, nil
+}
+
+func writeManifest(dir string, manifest *binaryManifest) error {
+	b, e := json.Marshal(manifest)
+	if e != nil {
+		return e
+	}
+
+	if e := os.WriteFile(filepath.Join(dir, manifestFile), b, 0644); e != nil {
+		return fmt.Errorf("write manifest failed: %s", e.Error())
+	}
+
+	return nil
+}
+
+// VerifyBinary checks the tree extracted into the default cache against
+// the manifest written when its extraction completed, comparing size
+// and modification time of every file, or their content hash when
+// full is set. A tree that
+// fails is re-extracted by DecompressBinary(true), New does that by
+// itself for the quick check.
+func VerifyBinary(full bool) error {
+	return verifyBinary(defaultBinaryRoot(), release.Sha256, full)
+}
+
+// verifyBinary checks root against its manifest, which must be of the
+// archive sum unless sum is empty.
+func verifyBinary(root, sum string, full bool) error {
+	b, e := os.ReadFile(filepath.Join(root, manifestFile))
+	if e != nil {
+		return fmt.Errorf("%w: no manifest, extraction did not complete", ErrBinaryDamaged)
+	}
+
+	manifest := &binaryManifest{}
+	if e := json.Unmarshal(b, manifest); e != nil {
+		return fmt.Errorf("%w: invalid manifest: %s", ErrBinaryDamaged, e.Error())
+	}
+
+	if sum != "" && manifest.Archive != sum {
+		return fmt.Errorf("%w: extracted from another archive", ErrBinaryDamaged)
+	}
+
+	for _, entry := range manifest.Files {
+		if e := verifyEntry(root, entry, full); e != nil {
+			return fmt.Errorf("%w: %s: %s", ErrBinaryDamaged, entry.Path, e.Error())
+		}
+	}
+
+	return nil
+}
+
+func verifyEntry(root string, entry manifestEntry, full bool) error {
+	path := filepath.Join(root, entry.Path)
+
+	if entry.Link != "" {
+		link, e := os.Readlink(path)
+		if e != nil {
+			return e
+		}
+
+		if link != entry.Link {
+			return errors.New("symlink changed")
 		}
 
 		return nil
-	}(); e != nil {
+	}
+
+	info, e := os.Lstat(path)
+	if e != nil {
 		return e
 	}
+
+	if !info.Mode().IsRegular() || info.Size() != entry.Size {
+		return errors.New("size changed")
+	}
+
+	if !full {
+		if !info.ModTime().Equal(entry.ModTime) {
+			return errors.New("modification time changed")
+		}
+
+		return nil
+	}
+
+	f, e := os.Open(path)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, e := io.Copy(h, f); e != nil {
+		return e
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != entry.Sha256 {
+		return errors.New("content changed")
+	}
+
+	return nil
+}
+
+func exportBinary(header *tar.Header, targetPath string, tarReader io.Reader) error {
+	switch header.Typeflag {
+	case tar.TypeReg:
+		return exportFile(targetPath, os.FileMode(header.Mode), tarReader)
+	case tar.TypeSymlink:
+		if e := os.RemoveAll(targetPath); e != nil {
+			return fmt.Errorf("remove symlink failed: %s", e.Error())
+		}
+
+		if e := os.Symlink(header.Linkname, targetPath); e != nil {
+			return fmt.Errorf("create symlink failed: %s", e.Error())
+		}
+	}
+
 	return nil
 }
 
+// exportFile writes r into the file targetPath and returns the first
+// error of writing and closing it.
+func exportFile(targetPath string, mode os.FileMode, r io.Reader) (e error) {
+	outFile, e := os.OpenFile(targetPath, os.O_CREATE|os.O_RDWR, mode)
+	if e != nil {
+		return fmt.Errorf("create file failed: %s", e.Error())
+	}
+
+	defer func() {
+		if ce := outFile.Close(); ce != nil && e == nil {
+			e = fmt.Errorf("close file failed: %s", ce.Error())
+		}
+	}()
+
+	if _, e := io.Copy(outFile, r); e != nil {
+		return fmt.Errorf("write file failed: %s", e.Error())
+	}
+
+	return nil
+}
+
+// sweepBinary removes the siblings of root left behind by interrupted
+// extractions and replaced trees past their grace period, it runs
+// while holding the extraction lock.
+func sweepBinary(root string) {
+	parent, base := filepath.Split(root)
+
+	entries, e := os.ReadDir(parent)
+	if e != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		switch {
+		case strings.HasPrefix(name, base+binaryTempInfix):
+		case strings.HasPrefix(name, base+binaryOldInfix):
+			nano, e := strconv.ParseInt(strings.TrimPrefix(name, base+binaryOldInfix), 10, 64)
+			if e != nil || time.Since(time.Unix(0, nano)) < oldBinaryGrace {
+				continue
+			}
+		default:
+			continue
+		}
+
+		os.RemoveAll(filepath.Join(parent, name))
+	}
+}
+
+// CleanBinary removes the binaries extracted into the default cache.
 func CleanBinary() error {
-	if f, _ := os.Stat(binaryRootPath); f != nil {
-		return os.RemoveAll(binaryRootPath)
+	root := defaultBinaryRoot()
+
+	lock, e := lockFile(root + ".lock")
+	if e != nil {
+		return e
+	}
+	defer lock.Unlock()
+
+	if f, _ := os.Stat(root); f != nil {
+		return os.RemoveAll(root)
 	}
 
 	return nil
@@ -0,0 +1,306 @@
+package gpgsql
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// the cache is resolved when the functions are called, not when the
+// package was initialized
+func TestCleanBinaryCacheDirEnv(t *testing.T) {
+	cache := t.TempDir()
+	t.Setenv(CacheDirEnv, cache)
+
+	root := defaultBinaryRoot()
+	if filepath.Dir(root) != cache {
+		t.Fatalf("binary root %s outside the cache %s", root, cache)
+	}
+
+	if e := os.MkdirAll(filepath.Join(root, "bin"), 0755); e != nil {
+		t.Fatal(e)
+	}
+
+	if e := VerifyBinary(false); e == nil {
+		t.Fatal("tree without manifest verified")
+	}
+
+	if e := CleanBinary(); e != nil {
+		t.Fatal(e)
+	}
+
+	if _, e := os.Stat(root); !os.IsNotExist(e) {
+		t.Fatalf("binary root left after CleanBinary: %v", e)
+	}
+}
+
+// testExtracted extracts the test archive into a fresh root.
+func testExtracted(t *testing.T) (string, []byte, string) {
+	t.Helper()
+
+	txz, sum := readTestArchive(t)
+	root := filepath.Join(t.TempDir(), "root")
+
+	if e := extractBinary(root, txz, sum, false); e != nil {
+		t.Fatal(e)
+	}
+
+	return root, txz, sum
+}
+
+func TestVerifyBinary(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		damage func(t *testing.T, path string)
+		quick  bool // the quick check notices it
+	}{
+		{"modified", func(t *testing.T, path string) {
+			if e := os.WriteFile(path, []byte("modified\n"), 0644); e != nil {
+				t.Fatal(e)
+			}
+		}, true},
+		{"truncated", func(t *testing.T, path string) {
+			if e := os.Truncate(path, 2); e != nil {
+				t.Fatal(e)
+			}
+		}, true},
+		{"removed", func(t *testing.T, path string) {
+			if e := os.Remove(path); e != nil {
+				t.Fatal(e)
+			}
+		}, true},
+		// same size and modification time, only the content hash tells
+		{"same size", func(t *testing.T, path string) {
+			info, e := os.Stat(path)
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			if e := os.WriteFile(path, []byte("SHARE\n"), 0644); e != nil {
+				t.Fatal(e)
+			}
+
+			if e := os.Chtimes(path, info.ModTime(), info.ModTime()); e != nil {
+				t.Fatal(e)
+			}
+		}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			root, txz, sum := testExtracted(t)
+
+			if e := verifyBinary(root, sum, true); e != nil {
+				t.Fatalf("fresh tree: %s", e.Error())
+			}
+
+			c.damage(t, filepath.Join(root, "share", "README"))
+
+			if e := verifyBinary(root, sum, false); (e == nil) == c.quick {
+				t.Fatalf("quick check gave %v", e)
+			}
+
+			if e := verifyBinary(root, sum, true); !errors.Is(e, ErrBinaryDamaged) {
+				t.Fatalf("full check gave %v, want %v", e, ErrBinaryDamaged)
+			}
+
+			// a damaged tree is extracted again, an intact one is kept
+			force := !c.quick
+			if e := extractBinary(root, txz, sum, force); e != nil {
+				t.Fatal(e)
+			}
+
+			checkExtracted(t, root)
+		})
+	}
+}
+
+func TestVerifyBinaryManifest(t *testing.T) {
+	root, _, sum := testExtracted(t)
+
+	if e := verifyBinary(root, strings.Repeat("0", 64), false); !errors.Is(e, ErrBinaryDamaged) {
+		t.Fatalf("other archive gave %v, want %v", e, ErrBinaryDamaged)
+	}
+
+	if e := os.Remove(filepath.Join(root, manifestFile)); e != nil {
+		t.Fatal(e)
+	}
+
+	if e := verifyBinary(root, sum, false); !errors.Is(e, ErrBinaryDamaged) {
+		t.Fatalf("missing manifest gave %v, want %v", e, ErrBinaryDamaged)
+	}
+}
+
+func TestExtractBinaryChecksum(t *testing.T) {
+	txz, _ := readTestArchive(t)
+	root := filepath.Join(t.TempDir(), "root")
+
+	if e := extractBinary(root, txz, strings.Repeat("0", 64), false); !errors.Is(e, ErrArchiveChecksum) {
+		t.Fatalf("got %v, want %v", e, ErrArchiveChecksum)
+	}
+
+	if _, e := os.Stat(root); !os.IsNotExist(e) {
+		t.Fatalf("root created for a bad archive: %v", e)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("broken archive")
+}
+
+func TestExportFileError(t *testing.T) {
+	e := exportFile(filepath.Join(t.TempDir(), "file"), 0644, failingReader{})
+	if e == nil || !strings.Contains(e.Error(), "broken archive") {
+		t.Fatalf("got %v, want the write error", e)
+	}
+}
+
+type tarEntry struct {
+	name, link, body string
+}
+
+func testTar(t *testing.T, entries ...tarEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry.body))}
+
+		if entry.link != "" {
+			header = &tar.Header{Name: entry.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: entry.link}
+		}
+
+		if e := w.WriteHeader(header); e != nil {
+			t.Fatal(e)
+		}
+
+		if _, e := w.Write([]byte(entry.body)); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	if e := w.Close(); e != nil {
+		t.Fatal(e)
+	}
+
+	return buf.Bytes()
+}
+
+// crafted archives never write outside the extraction directory
+func TestExtractTarContained(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{"dot dot", []tarEntry{{name: "../evil", body: "evil"}}},
+		{"nested dot dot", []tarEntry{{name: "bin/../../evil", body: "evil"}}},
+		{"absolute", []tarEntry{{name: "/evil", body: "evil"}}},
+		{"symlink out", []tarEntry{{name: "bin/out", link: "../../"}}},
+		{"absolute symlink", []tarEntry{{name: "out", link: "/"}}},
+		{"write through symlink", []tarEntry{
+			{name: "lib", link: "bin"},
+			{name: "lib/evil", body: "evil"},
+		}},
+		{"overwrite symlink", []tarEntry{
+			{name: "bin/postgres", body: "postgres"},
+			{name: "link", link: "bin/postgres"},
+			{name: "link", body: "evil"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "a", "b")
+
+			if e := os.MkdirAll(dir, os.ModePerm); e != nil {
+				t.Fatal(e)
+			}
+
+			if e := extractTar(dir, bytes.NewReader(testTar(t, tt.entries...)), ""); e == nil {
+				t.Fatal("crafted archive extracted")
+			}
+
+			for _, path := range []string{filepath.Join(parent, "evil"), filepath.Join(parent, "a", "evil"), filepath.Join(dir, "bin", "evil")} {
+				if _, e := os.Lstat(path); !os.IsNotExist(e) {
+					t.Fatalf("%s written: %v", path, e)
+				}
+			}
+
+			if b, e := os.ReadFile(filepath.Join(dir, "bin", "postgres")); e == nil && string(b) != "postgres" {
+				t.Fatalf("written through symlink: %q", b)
+			}
+		})
+	}
+
+	// symlinks staying inside are extracted as usual
+	dir := t.TempDir()
+
+	e := extractTar(dir, bytes.NewReader(testTar(t,
+		tarEntry{name: "lib/libpq.so.5", body: "libpq"},
+		tarEntry{name: "lib/libpq.so", link: "libpq.so.5"},
+		tarEntry{name: "bin/lib", link: "../lib"},
+	)), "")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if b, e := os.ReadFile(filepath.Join(dir, "bin", "lib", "libpq.so")); e != nil || string(b) != "libpq" {
+		t.Fatalf("got %q, %v", b, e)
+	}
+}
+
+// extractions racing on one root take turns on the lock file and
+// leave a single complete tree, never a partial one
+func TestExtractBinaryConcurrent(t *testing.T) {
+	txz, sum := readTestArchive(t)
+	root := filepath.Join(t.TempDir(), "root")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+
+	for n := 0; n < cap(errs); n++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if e := extractBinary(root, txz, sum, false); e != nil {
+				errs <- e
+				return
+			}
+
+			// whoever returns sees a complete tree
+			errs <- verifyBinary(root, sum, true)
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for e := range errs {
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	checkExtracted(t, root)
+
+	entries, e := os.ReadDir(filepath.Dir(root))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), binaryTempInfix) {
+			t.Fatalf("temp tree %s left behind", entry.Name())
+		}
+	}
+}
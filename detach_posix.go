@@ -0,0 +1,13 @@
+//go:build !windows
+
+package gpgsql
+
+import (
+	"syscall"
+)
+
+// detachSysProcAttr starts a process in a session of its own, the
+// signals of our terminal don't reach it.
+func detachSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
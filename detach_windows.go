@@ -0,0 +1,16 @@
+package gpgsql
+
+import (
+	"syscall"
+)
+
+const (
+	// DETACHED_PROCESS, the process has no console
+	detachedProcess = 0x00000008
+)
+
+// detachSysProcAttr starts a process without our console and in a
+// process group of its own, the ctrl-c of our console doesn't reach it.
+func detachSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP | detachedProcess}
+}
@@ -0,0 +1,197 @@
+package gpgsql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ephemeral data directories are named prefix + owner pid + "-" + random
+	ephemeralPrefix = "gpgsql-ephemeral-"
+
+	// tmpfs of most linux systems
+	sharedMemoryDir = "/dev/shm"
+)
+
+var (
+	defaultEphemeralOptions = &EphemeralOptions{}
+
+	// settings without durability, an ephemeral cluster is thrown away anyway
+	ephemeralParma = map[string]string{
+		"synchronous_commit": "off",
+		"full_page_writes":   "off",
+	}
+)
+
+type EphemeralOptions struct {
+	Dir     string          // parent of the data directory, os.TempDir() by default
+	Memory  bool            // put the data directory on tmpfs (/dev/shm) when available
+	Runtime *RuntimeOptions // where the binaries come from, see NewRuntime
+}
+
+// Ephemeral returns a runtime on a private temp data directory. The
+// server runs without durability, listens on a unix socket inside the
+// directory, and the directory is removed on Stop. Defer Cleanup to
+// remove it after a panic as well. Directories left behind by dead
+// processes are removed here.
+func Ephemeral(opts ...*EphemeralOptions) (*GpgsqlRuntime, error) {
+	if len(opts) < 1 || opts[0] == nil {
+		opts = append(opts[:0], defaultEphemeralOptions)
+	}
+
+	opt := opts[0]
+
+	g, e := NewRuntime(opt.Runtime)
+	if e != nil {
+		return nil, e
+	}
+
+	parent := opt.Dir
+	if parent == "" {
+		parent = os.TempDir()
+	}
+
+	if opt.Memory {
+		if f, _ := os.Stat(sharedMemoryDir); f != nil && f.IsDir() {
+			parent = sharedMemoryDir
+		}
+	}
+
+	sweepEphemeral(parent)
+
+	data, e := os.MkdirTemp(parent, fmt.Sprintf("%s%d-*", ephemeralPrefix, os.Getpid()))
+	if e != nil {
+		return nil, fmt.Errorf("failed to create data directory: %s", e.Error())
+	}
+
+	if e := os.Chmod(data, PostgresqlDataPerm); e != nil {
+		os.RemoveAll(data)
+		return nil, e
+	}
+
+	g.data = data
+	g.ephemeral = true
+
+	return g, nil
+}
+
+// ephemeralOptions adds the ephemeral settings to a copy of opt,
+// everything set explicitly is kept. A Parma key turns off the
+// setting of the same name, e.g. "fsync" keeps FsyncOff unset.
+func (g *GpgsqlRuntime) ephemeralOptions(opt *PostgreSqlOptions) *PostgreSqlOptions {
+	o := *opt
+
+	// parameter names are case insensitive
+	set := map[string]bool{}
+
+	o.Parma = map[string]string{}
+	for k, v := range opt.Parma {
+		o.Parma[k] = v
+		set[strings.ToLower(strings.TrimSpace(k))] = true
+	}
+
+	if !set["fsync"] {
+		o.FsyncOff = true
+	}
+
+	for k, v := range ephemeralParma {
+		if !set[k] {
+			o.Parma[k] = v
+		}
+	}
+
+	if runtime.GOOS == "windows" || strings.TrimSpace(o.UnixSocket) != "" {
+		return &o
+	}
+
+	if set["unix_socket_directories"] {
+		return &o
+	}
+
+	socket := filepath.Join(g.data, fmt.Sprintf(".s.PGSQL.%d", g.port))
+	if len(socket) <= maxUnixSocketPath {
+		o.UnixSocket = g.data
+	} else {
+		// too long for sun_path, tcp only then
+		o.Parma["unix_socket_directories"] = ""
+	}
+
+	return &o
+}
+
+// Cleanup stops the server in immediate mode and removes the data
+// directory of an ephemeral runtime. It is meant to be deferred right
+// after Ephemeral, deferred calls also run while a panic unwinds.
+func (g *GpgsqlRuntime) Cleanup() error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
+	defer cancel()
+
+	status, e := g.Status(ctx)
+	if e != nil {
+		return fmt.Errorf("failed to get status: %s", e.Error())
+	}
+
+	switch status.State {
+	case StateRunning, StateStarting, StateStopping:
+		if e := g.PgCli(ctx, CliStop, &PgCliOptions{
+			Wait: true,
+			Mode: string(ShutdownImmediate),
+		}); e != nil {
+			return fmt.Errorf("failed to stop postgres: %s", e.Error())
+		}
+	}
+
+	return g.removeEphemeral()
+}
+
+// removeEphemeral removes the data directory of an ephemeral runtime.
+func (g *GpgsqlRuntime) removeEphemeral() error {
+	if !g.ephemeral {
+		return nil
+	}
+
+	if e := os.RemoveAll(g.data); e != nil {
+		return fmt.Errorf("failed to remove data directory: %s", e.Error())
+	}
+
+	return nil
+}
+
+// sweepEphemeral removes ephemeral data directories in parent whose
+// owner process is gone and that no server runs on.
+func sweepEphemeral(parent string) {
+	entries, e := os.ReadDir(parent)
+	if e != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !strings.HasPrefix(name, ephemeralPrefix) {
+			continue
+		}
+
+		owner, _, _ := strings.Cut(strings.TrimPrefix(name, ephemeralPrefix), "-")
+
+		pid, e := strconv.Atoi(owner)
+		if e != nil || processAlive(pid) {
+			continue
+		}
+
+		dir := filepath.Join(parent, name)
+
+		if p, e := readPostmasterPid(dir); e == nil && postmasterAlive(p) {
+			continue
+		} else if e != nil && !errors.Is(e, os.ErrNotExist) {
+			continue
+		}
+
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,48 @@
+package gpgsql
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEphemeralOptions(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		opt   *PostgreSqlOptions
+		want  []string
+		never []string
+	}{
+		{"defaults", &PostgreSqlOptions{},
+			[]string{"-F", "-c full_page_writes=off", "-c synchronous_commit=off"}, nil},
+		{"fsync on", &PostgreSqlOptions{Parma: map[string]string{"fsync": "on"}},
+			[]string{"-c fsync=on", "-c full_page_writes=off", "-c synchronous_commit=off"}, []string{"-F"}},
+		{"upper case", &PostgreSqlOptions{Parma: map[string]string{"FSYNC": "on", "Synchronous_Commit": "on"}},
+			[]string{"-c FSYNC=on", "-c Synchronous_Commit=on", "-c full_page_writes=off"}, []string{"-F", "synchronous_commit=off"}},
+		{"full page writes", &PostgreSqlOptions{Parma: map[string]string{"full_page_writes": "on"}},
+			[]string{"-F", "-c full_page_writes=on", "-c synchronous_commit=off"}, []string{"full_page_writes=off"}},
+		{"fsync off", &PostgreSqlOptions{FsyncOff: true}, []string{"-F"}, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			g := &GpgsqlRuntime{port: 5433, data: t.TempDir(), ephemeral: true}
+
+			args, e := g.DaemonArgs(c.opt)
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			joined := " " + strings.Join(args, " ") + " "
+
+			for _, want := range c.want {
+				if !strings.Contains(joined, " "+want+" ") {
+					t.Errorf("%q misses %q", args, want)
+				}
+			}
+
+			for _, never := range c.never {
+				if strings.Contains(joined, never) {
+					t.Errorf("%q holds %q", args, never)
+				}
+			}
+		})
+	}
+}
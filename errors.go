@@ -0,0 +1,103 @@
+package gpgsql
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrPortInUse           = errors.New("port is already in use")
+	ErrDataDirLocked       = errors.New("data directory is in use by another server")
+	ErrDataDirPermissions  = errors.New("data directory has wrong permissions")
+	ErrRunningAsRoot       = errors.New("postgres cannot run as root")
+	ErrIncompatibleVersion = errors.New("data directory is incompatible with the server version")
+	ErrInvalidLocale       = errors.New("invalid locale")
+	ErrSharedMemory        = errors.New("shared memory exhausted")
+	ErrAuthentication      = errors.New("authentication failed")
+
+	// lower case messages of postgres, initdb and pg_ctl, checked in order
+	outputPatterns = []struct {
+		err      error
+		patterns []string
+	}{
+		{ErrRunningAsRoot, []string{
+			"cannot be run as root",
+			"\"root\" execution of the postgresql server is not permitted",
+			"execution of postgresql by a user with administrative permissions is not permitted",
+		}},
+		{ErrPortInUse, []string{
+			"address already in use",
+			"could not create any tcp/ip sockets",
+			"already running on port",
+		}},
+		{ErrDataDirLocked, []string{
+			"lock file \"postmaster.pid\" already exists",
+			"running in data directory",
+		}},
+		{ErrDataDirPermissions, []string{
+			"has invalid permissions",
+			"has group or world access",
+			"could not change permissions of directory",
+			"has wrong ownership",
+		}},
+		{ErrIncompatibleVersion, []string{
+			"database files are incompatible with server",
+			"was initialized by postgresql version",
+		}},
+		{ErrInvalidLocale, []string{
+			"invalid locale name",
+			"invalid locale settings",
+			"does not match the encoding of the selected locale",
+			"encoding mismatch",
+		}},
+		{ErrSharedMemory, []string{
+			"could not create shared memory segment",
+			"could not map anonymous shared memory",
+			"could not resize shared memory segment",
+			"out of shared memory",
+		}},
+		{ErrAuthentication, []string{
+			"password authentication failed",
+			"authentication failed for user",
+			"no pg_hba.conf entry",
+		}},
+	}
+)
+
+// OutputError is a failure reported through the output of postgres,
+// initdb or pg_ctl. Err is the matching sentinel error, or nil when
+// the output is not recognized.
+type OutputError struct {
+	Err    error
+	Output string
+}
+
+func (e *OutputError) Error() string {
+	if e.Err == nil {
+		return e.Output
+	}
+
+	return fmt.Sprintf("%s: %s", e.Err.Error(), e.Output)
+}
+
+func (e *OutputError) Unwrap() error {
+	return e.Err
+}
+
+// ClassifyOutput maps known messages in output to the sentinel errors,
+// so callers can use errors.Is on the returned *OutputError.
+func ClassifyOutput(output string) error {
+	output = strings.TrimSpace(output)
+	lower := strings.ToLower(output)
+
+	for _, p := range outputPatterns {
+		for _, pattern := range p.patterns {
+			if strings.Contains(lower, pattern) {
+				return &OutputError{Err: p.err, Output: output}
+			}
+		}
+	}
+
+	return &OutputError{Output: output}
+}
@@ -0,0 +1,75 @@
+package gpgsql
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestClassifyOutput(t *testing.T) {
+	sentinels := []error{
+		ErrPortInUse, ErrDataDirLocked, ErrDataDirPermissions, ErrRunningAsRoot,
+		ErrIncompatibleVersion, ErrInvalidLocale, ErrSharedMemory, ErrAuthentication,
+	}
+
+	for _, c := range []struct {
+		name   string
+		output string
+		want   error
+	}{
+		{"tcp sockets", "LOG:  could not bind IPv4 address \"127.0.0.1\": Address already in use\n" +
+			"HINT:  Is another postmaster already running on port 5432? If not, wait a few seconds and retry.\n" +
+			"FATAL:  could not create any TCP/IP sockets\n", ErrPortInUse},
+		{"pg_ctl port", "pg_ctl: could not start server\nExamine the log output.\n" +
+			"FATAL:  could not create any TCP/IP sockets", ErrPortInUse},
+		{"lock file", "FATAL:  lock file \"postmaster.pid\" already exists\n" +
+			"HINT:  Is another postmaster (PID 4242) running in data directory \"/var/lib/postgresql/data\"?", ErrDataDirLocked},
+		{"permissions", "FATAL:  data directory \"/var/lib/postgresql/data\" has invalid permissions\n" +
+			"DETAIL:  Permissions should be u=rwx (0700) or u=rwx,g=rx (0750).", ErrDataDirPermissions},
+		{"ownership", "FATAL:  data directory \"/data\" has wrong ownership\n" +
+			"HINT:  The server must be started by the user that owns the data directory.", ErrDataDirPermissions},
+		{"initdb root", "initdb: error: cannot be run as root\n" +
+			"initdb: hint: Please log in (using, e.g., \"su\") as the (unprivileged) user that will own the server process.", ErrRunningAsRoot},
+		{"postgres root", "\"root\" execution of the PostgreSQL server is not permitted.\n" +
+			"The server must be started under an unprivileged user ID to prevent\n" +
+			"possible system security compromise.  See the documentation for\n" +
+			"more information on how to properly start the server.", ErrRunningAsRoot},
+		{"pg_ctl root", "pg_ctl: cannot be run as root\n" +
+			"Please log in (using, e.g., \"su\") as the (unprivileged) user that will\n" +
+			"own the server process.", ErrRunningAsRoot},
+		{"version", "FATAL:  database files are incompatible with server\n" +
+			"DETAIL:  The data directory was initialized by PostgreSQL version 13, which is not compatible with this version 14.5.", ErrIncompatibleVersion},
+		{"locale", "initdb: error: invalid locale name \"xx_XX.UTF-8\"", ErrInvalidLocale},
+		{"encoding", "initdb: error: encoding mismatch\n" +
+			"initdb: detail: The encoding you selected (UTF8) and the encoding that the selected locale uses (LATIN1) do not match.", ErrInvalidLocale},
+		{"shared memory", "FATAL:  could not create shared memory segment: No space left on device\n" +
+			"DETAIL:  Failed system call was shmget(key=5432001, size=56, 03600).", ErrSharedMemory},
+		{"anonymous shared memory", "FATAL:  could not map anonymous shared memory: Cannot allocate memory", ErrSharedMemory},
+		{"password 28P01", "FATAL:  password authentication failed for user \"postgres\"", ErrAuthentication},
+		{"pg_hba", "FATAL:  no pg_hba.conf entry for host \"10.0.0.1\", user \"postgres\", database \"postgres\", no encryption", ErrAuthentication},
+		{"unknown", "FATAL:  the database system is starting up\n", nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			e := ClassifyOutput(c.output)
+
+			var out *OutputError
+			if !errors.As(e, &out) {
+				t.Fatalf("got %T, want *OutputError", e)
+			}
+
+			if out.Output != strings.TrimSpace(c.output) {
+				t.Fatalf("Output %q, want the raw output %q", out.Output, c.output)
+			}
+
+			if !strings.Contains(e.Error(), out.Output) {
+				t.Fatalf("error %q does not hold the output", e.Error())
+			}
+
+			for _, sentinel := range sentinels {
+				if errors.Is(e, sentinel) != (sentinel == c.want) {
+					t.Errorf("errors.Is(%v) = %t, want %v", sentinel, errors.Is(e, sentinel), c.want)
+				}
+			}
+		})
+	}
+}
@@ -31,44 +31,25 @@ func main() {
 		logger.Fatal("add data failed: %s", e.Error())
 	}
 
-	if t, e := g.IsEmptyData(); e != nil {
-		logger.Fatal("is empty data failed: %s", e.Error())
-	} else if t {
-		if e := g.Initdb(context.Background(), &gpgsql.InitdbOptions{
+	instance, e := g.EnsureReady(context.Background(), &gpgsql.ReadySpec{
+		Initdb: &gpgsql.InitdbOptions{
 			Encoding:   "UTF8",
 			Locale:     "en_US.UTF-8",
 			AuthMethod: "password",
-		}); e != nil {
-			logger.Fatal("initdb failed: %s", e.Error())
-		}
-	}
-
-	{
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-
-		if e := g.Stop(ctx); e != nil {
-			logger.Fatal("stop failed: %s", e.Error())
-		}
+		},
+		Server: &gpgsql.PostgreSqlOptions{
+			Timeout: 10 * time.Second, // retry connections until ready, at most this long
+		},
+	})
+	if e != nil {
+		logger.Fatal("postgresql start failed: %s", e.Error())
 	}
 
-	{
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-
-		if e := g.Start(ctx, &gpgsql.PostgreSqlOptions{
-			Wait:    3 * time.Second,
-			Timeout: 5 * time.Second,
-		}); e != nil {
-			logger.Fatal("postgresql start failed: %s", e.Error())
-		}
-
-		logger.Info("postgresql is running")
-		logger.Debug("postgresql listening on %s", g.ListenAddr())
-	}
+	logger.Info("postgresql is running, pid: %d", instance.PID())
+	logger.Debug("postgresql listening on %s", instance.ListenAddr())
 
 	defer func() {
-		if e := g.Stop(context.Background()); e != nil {
+		if e := instance.Stop(context.Background(), gpgsql.ShutdownFast); e != nil {
 			logger.Fatal("postgresql stop failed: %s", e.Error())
 		}
 
@@ -0,0 +1,33 @@
+package gpgsql
+
+import (
+	"fmt"
+	"os"
+)
+
+// fileLock is an exclusive lock shared between processes, the
+// operating system releases it when the holder dies.
+type fileLock struct {
+	f *os.File
+}
+
+// lockFile blocks until it holds the lock on path, creating the file.
+func lockFile(path string) (*fileLock, error) {
+	f, e := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if e != nil {
+		return nil, fmt.Errorf("failed to open lock file: %s", e.Error())
+	}
+
+	if e := lockFd(f); e != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %s", path, e.Error())
+	}
+
+	return &fileLock{f: f}, nil
+}
+
+func (l *fileLock) Unlock() error {
+	defer l.f.Close()
+
+	return unlockFd(l.f)
+}
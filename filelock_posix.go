@@ -0,0 +1,22 @@
+//go:build !windows
+
+package gpgsql
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func lockFd(f *os.File) error {
+	for {
+		e := syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if !errors.Is(e, syscall.EINTR) {
+			return e
+		}
+	}
+}
+
+func unlockFd(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,44 @@
+//go:build windows
+
+package gpgsql
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	lockfileExclusiveLock = 0x2 // LOCKFILE_EXCLUSIVE_LOCK
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+// lockFd locks the whole file, blocking until it is free.
+func lockFd(f *os.File) error {
+	var ol syscall.Overlapped
+
+	r, _, e := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock, 0,
+		0xffffffff, 0xffffffff, uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		return e
+	}
+
+	return nil
+}
+
+func unlockFd(f *os.File) error {
+	var ol syscall.Overlapped
+
+	r, _, e := procUnlockFileEx.Call(f.Fd(), 0,
+		0xffffffff, 0xffffffff, uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		return e
+	}
+
+	return nil
+}
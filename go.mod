@@ -1,6 +1,6 @@
 module github.com/ClarkQAQ/gpgsql
 
-go 1.19
+go 1.21
 
 replace utilware => github.com/ClarkQAQ/utilware v0.0.0-20221011033505-5f6223fb57f4
 
@@ -0,0 +1,411 @@
+// Package gpgsqltest starts embedded postgres servers for go tests.
+//
+// Servers of New are stopped by tb.Cleanup. The shared server of
+// Options.Shared, NewTemplate and Tx outlives every single test, so no
+// test stops it: call Shutdown from TestMain after m.Run. Without it
+// the server dies with the test binary on linux only, elsewhere it
+// keeps running after the tests have finished. A server shared with
+// Options.Packages is stopped by the last test binary releasing it, or
+// by its reaper when the test binaries died, see gpgsql.Share.
+package gpgsqltest
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ClarkQAQ/gpgsql"
+)
+
+const (
+	Username = "postgres"
+	Password = "postgres"
+
+	// server output kept for failed tests, older output is dropped
+	maxLogBuffer = 1 << 20
+)
+
+var (
+	defaultOptions = &Options{}
+
+	// server shared by every test of the process
+	shared struct {
+		once     sync.Once
+		runtime  *gpgsql.GpgsqlRuntime
+		instance *gpgsql.Instance
+		lease    *gpgsql.SharedServer
+		logs     *logBuffer
+		err      error
+	}
+
+	// database templates on the shared server by name
+	templates struct {
+		mu sync.Mutex
+		m  map[string]*gpgsql.DatabaseTemplate
+	}
+)
+
+type Options struct {
+	Runtime  *gpgsql.RuntimeOptions    // binaries and version, see gpgsql.NewRuntime
+	Initdb   *gpgsql.InitdbOptions     // trust auth without locale by default
+	Server   *gpgsql.PostgreSqlOptions // server options
+	Database string                    // database to connect to, Username by default
+	Shared   bool                      // reuse one server for the whole test binary
+	Packages bool                      // with Shared, share the server with the other test binaries of go test ./..., see gpgsql.Share
+	Memory   bool                      // put the data directory on tmpfs when available
+	Timeout  time.Duration             // startup timeout, 1 minute by default
+}
+
+// New starts an ephemeral server for tb, or reuses the shared one with
+// Options.Shared, and returns a connected *sql.DB and its DSN. The
+// server is stopped and removed by tb.Cleanup, server logs are written
+// to tb.Log only when the test failed.
+func New(tb testing.TB, opts ...*Options) (*sql.DB, string) {
+	tb.Helper()
+
+	if len(opts) < 1 || opts[0] == nil {
+		opts = append(opts[:0], defaultOptions)
+	}
+
+	opt := opts[0]
+
+	var (
+		g    *gpgsql.GpgsqlRuntime
+		logs *logBuffer
+		mark int
+	)
+
+	if opt.Shared {
+		g = sharedServer(tb, opt)
+		logs, mark = shared.logs, shared.logs.len()
+	} else {
+		logs = &logBuffer{}
+
+		r, _, e := start(opt, logs)
+		if e != nil {
+			tb.Fatalf("gpgsqltest: failed to start server: %s\n%s", e.Error(), logs.since(0))
+		}
+
+		g = r
+	}
+
+	dbname := opt.Database
+	if dbname == "" {
+		dbname = Username
+	}
+
+	db, e := g.DB(dbname)
+	if e != nil {
+		tb.Fatalf("gpgsqltest: failed to open database: %s", e.Error())
+	}
+
+	tb.Cleanup(func() {
+		db.Close()
+		logFailure(tb, logs, mark)
+
+		if !opt.Shared {
+			if e := g.Cleanup(); e != nil {
+				tb.Errorf("gpgsqltest: failed to clean up server: %s", e.Error())
+			}
+		}
+	})
+
+	return db, g.DSN(dbname)
+}
+
+// NewTemplate returns the template database name on the shared server,
+// migrated the first time it is requested by the test binary. The
+// server is started with opts when it is not running yet.
+func NewTemplate(tb testing.TB, name string, tmpl *gpgsql.DatabaseTemplateOptions, opts ...*Options) *gpgsql.DatabaseTemplate {
+	tb.Helper()
+
+	if len(opts) < 1 || opts[0] == nil {
+		opts = append(opts[:0], defaultOptions)
+	}
+
+	g := sharedServer(tb, opts[0])
+
+	templates.mu.Lock()
+	defer templates.mu.Unlock()
+
+	if t, ok := templates.m[name]; ok {
+		return t
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout(opts[0]))
+	defer cancel()
+
+	t, e := g.DatabaseTemplate(ctx, name, tmpl)
+	if e != nil {
+		tb.Fatalf("gpgsqltest: failed to create template %s: %s\n%s", name, e.Error(), shared.logs.since(0))
+	}
+
+	if templates.m == nil {
+		templates.m = map[string]*gpgsql.DatabaseTemplate{}
+	}
+
+	templates.m[name] = t
+	return t
+}
+
+// Clone gives tb its own database cloned from t and returns a connected
+// *sql.DB and its DSN, the database is dropped by tb.Cleanup. Safe for
+// parallel tests. t must come from NewTemplate, Clone fails tb otherwise.
+func Clone(tb testing.TB, t *gpgsql.DatabaseTemplate) (*sql.DB, string) {
+	tb.Helper()
+
+	if t == nil {
+		tb.Fatalf("gpgsqltest: no template to clone")
+	}
+
+	if !sharedTemplate(t) {
+		tb.Fatalf("gpgsqltest: template %s does not come from NewTemplate", t.Name())
+	}
+
+	mark := shared.logs.len()
+
+	dbname, e := t.Clone(context.Background())
+	if e != nil {
+		tb.Fatalf("gpgsqltest: failed to clone %s: %s", t.Name(), e.Error())
+	}
+
+	db, e := shared.runtime.DB(dbname)
+	if e != nil {
+		tb.Fatalf("gpgsqltest: failed to open database: %s", e.Error())
+	}
+
+	tb.Cleanup(func() {
+		db.Close()
+		logFailure(tb, shared.logs, mark)
+
+		if e := t.Drop(context.Background(), dbname); e != nil {
+			tb.Errorf("gpgsqltest: failed to drop %s: %s", dbname, e.Error())
+		}
+	})
+
+	return db, shared.runtime.DSN(dbname)
+}
+
+// Tx returns a *sql.DB on the shared server whose changes are rolled
+// back by tb.Cleanup, see gpgsql.TxDriverName. Nothing tb does is seen
+// by other tests, committed or not.
+func Tx(tb testing.TB, opts ...*Options) *sql.DB {
+	tb.Helper()
+
+	if len(opts) < 1 || opts[0] == nil {
+		opts = append(opts[:0], defaultOptions)
+	}
+
+	g := sharedServer(tb, opts[0])
+	mark := shared.logs.len()
+
+	dbname := opts[0].Database
+	if dbname == "" {
+		dbname = Username
+	}
+
+	db, e := g.TxDB(dbname)
+	if e != nil {
+		tb.Fatalf("gpgsqltest: failed to open database: %s", e.Error())
+	}
+
+	tb.Cleanup(func() {
+		logFailure(tb, shared.logs, mark)
+
+		if e := db.Close(); e != nil {
+			tb.Errorf("gpgsqltest: failed to roll back: %s", e.Error())
+		}
+	})
+
+	return db
+}
+
+// Shutdown stops the shared server, call it from TestMain after m.Run.
+// Without it the server dies with the test binary on linux and its
+// data directory is removed by a later run. With Options.Packages it
+// releases the lease instead, the last test binary stops the server.
+func Shutdown() error {
+	if shared.runtime == nil {
+		return nil
+	}
+
+	templates.mu.Lock()
+	for _, t := range templates.m {
+		t.Close(context.Background())
+	}
+	templates.mu.Unlock()
+
+	if shared.lease != nil {
+		return shared.lease.Release(context.Background())
+	}
+
+	return shared.runtime.Cleanup()
+}
+
+// sharedTemplate reports whether NewTemplate created t on the shared server.
+func sharedTemplate(t *gpgsql.DatabaseTemplate) bool {
+	templates.mu.Lock()
+	defer templates.mu.Unlock()
+
+	return templates.m[t.Name()] == t
+}
+
+// sharedServer starts the shared server on first use.
+func sharedServer(tb testing.TB, opt *Options) *gpgsql.GpgsqlRuntime {
+	tb.Helper()
+
+	shared.once.Do(func() {
+		shared.logs = &logBuffer{}
+
+		if opt.Packages {
+			shared.lease, shared.err = share(opt, shared.logs)
+			if shared.err == nil {
+				shared.runtime = shared.lease.Runtime()
+			}
+
+			return
+		}
+
+		shared.runtime, shared.instance, shared.err = start(opt, shared.logs)
+	})
+
+	if shared.err != nil {
+		tb.Fatalf("gpgsqltest: failed to start shared server: %s\n%s", shared.err.Error(), shared.logs.since(0))
+	}
+
+	return shared.runtime
+}
+
+// share takes a lease on the server shared by the test binaries.
+func share(opt *Options, logs *logBuffer) (*gpgsql.SharedServer, error) {
+	g, e := gpgsql.NewRuntime(opt.Runtime)
+	if e != nil {
+		return nil, e
+	}
+
+	g.Username(Username).Password(Password).Logger(logs)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout(opt))
+	defer cancel()
+
+	return g.Share(ctx, &gpgsql.SharedOptions{
+		Name:   "gpgsqltest",
+		Initdb: initdb(opt),
+		Server: server(opt),
+	})
+}
+
+func initdb(opt *Options) *gpgsql.InitdbOptions {
+	if opt.Initdb != nil {
+		return opt.Initdb
+	}
+
+	return &gpgsql.InitdbOptions{
+		Encoding:   "UTF8",
+		NoLocale:   true,
+		AuthMethod: "trust",
+	}
+}
+
+// server waits for readiness as long as for the whole startup unless
+// the options say otherwise.
+func server(opt *Options) *gpgsql.PostgreSqlOptions {
+	server := gpgsql.PostgreSqlOptions{}
+	if opt.Server != nil {
+		server = *opt.Server
+	}
+
+	if server.Timeout < 1 {
+		server.Timeout = timeout(opt)
+	}
+
+	return &server
+}
+
+func timeout(opt *Options) time.Duration {
+	if opt.Timeout < 1 {
+		return time.Minute
+	}
+
+	return opt.Timeout
+}
+
+func start(opt *Options, logs *logBuffer) (*gpgsql.GpgsqlRuntime, *gpgsql.Instance, error) {
+	g, e := gpgsql.Ephemeral(&gpgsql.EphemeralOptions{Memory: opt.Memory, Runtime: opt.Runtime})
+	if e != nil {
+		return nil, nil, e
+	}
+
+	g.Username(Username).Password(Password).Logger(logs)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout(opt))
+	defer cancel()
+
+	instance, e := g.EnsureReady(ctx, &gpgsql.ReadySpec{
+		Initdb:   initdb(opt),
+		Server:   server(opt),
+		Daemon:   true,
+		Template: true,
+	})
+	if e != nil {
+		g.Cleanup()
+		return nil, nil, e
+	}
+
+	return g, instance, nil
+}
+
+// logFailure writes the server output since mark to tb.Log, only when
+// tb failed.
+func logFailure(tb testing.TB, logs *logBuffer, mark int) {
+	if tb.Failed() {
+		tb.Logf("gpgsqltest: server log:\n%s", logs.since(mark))
+	}
+}
+
+// logBuffer keeps the last maxLogBuffer bytes of the server output so
+// failed tests can print it. Offsets count every byte ever written.
+type logBuffer struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	written int
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n, e := b.buf.Write(p)
+	b.written += n
+
+	if drop := b.buf.Len() - maxLogBuffer; drop > 0 {
+		b.buf.Next(drop)
+	}
+
+	return n, e
+}
+
+func (b *logBuffer) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.written
+}
+
+// since returns the output written after offset, noting how much of
+// it was dropped already.
+func (b *logBuffer) since(offset int) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	start := offset - (b.written - b.buf.Len())
+	if start >= 0 {
+		return string(b.buf.Bytes()[start:])
+	}
+
+	return fmt.Sprintf("[%d bytes dropped]\n%s", -start, b.buf.Bytes())
+}
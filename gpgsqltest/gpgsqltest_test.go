@@ -0,0 +1,283 @@
+package gpgsqltest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClarkQAQ/gpgsql"
+	"github.com/ClarkQAQ/gpgsql/release"
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+
+	if e := Shutdown(); e != nil {
+		fmt.Fprintf(os.Stderr, "gpgsqltest: %s\n", e.Error())
+		code = 1
+	}
+
+	os.Exit(code)
+}
+
+// skipWithoutPostgres skips tb where the embedded binaries cannot run
+// a server.
+func skipWithoutPostgres(tb testing.TB) {
+	tb.Helper()
+
+	if testing.Short() {
+		tb.Skip("runs postgres")
+	}
+
+	if runtime.GOOS != "windows" && os.Geteuid() == 0 {
+		tb.Skip("postgres cannot run as root")
+	}
+
+	g, e := gpgsql.New()
+	if e != nil {
+		tb.Skipf("no postgres binaries: %s", e.Error())
+	}
+
+	if e := exec.Command(filepath.Join(g.BinaryDir(), release.PostgresBinary), "-V").Run(); e != nil {
+		tb.Skipf("postgres binaries do not run: %s", e.Error())
+	}
+}
+
+// the shared server is started through pg_ctl while the output goes
+// to the log buffer, which must not keep Share waiting
+func TestPackages(t *testing.T) {
+	skipWithoutPostgres(t)
+
+	db, _ := New(t, &Options{Shared: true, Packages: true})
+
+	var n int
+	if e := db.QueryRow("SELECT 1").Scan(&n); e != nil || n != 1 {
+		t.Fatalf("SELECT 1 = %d: %v", n, e)
+	}
+}
+
+// fakeTB records what is logged and runs its cleanups on demand,
+// everything else goes to the real test.
+type fakeTB struct {
+	testing.TB
+	failed   bool
+	fatal    bool // Fatalf is recorded instead of failing the real test
+	logs     []string
+	cleanups []func()
+}
+
+func (f *fakeTB) Helper() {}
+
+func (f *fakeTB) Failed() bool {
+	return f.failed
+}
+
+func (f *fakeTB) Logf(format string, args ...any) {
+	f.logs = append(f.logs, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeTB) Cleanup(fn func()) {
+	f.cleanups = append(f.cleanups, fn)
+}
+
+// Fatalf records the message and ends the goroutine like testing does
+// when fatal is set, run the code under test in its own goroutine then.
+func (f *fakeTB) Fatalf(format string, args ...any) {
+	if !f.fatal {
+		f.TB.Fatalf(format, args...)
+	}
+
+	f.failed = true
+	f.logs = append(f.logs, fmt.Sprintf(format, args...))
+	runtime.Goexit()
+}
+
+// cleanup runs the cleanups last added first, like testing does.
+func (f *fakeTB) cleanup() {
+	for n := len(f.cleanups) - 1; n >= 0; n-- {
+		f.cleanups[n]()
+	}
+
+	f.cleanups = nil
+}
+
+func TestLogFailure(t *testing.T) {
+	logs := &logBuffer{}
+	fmt.Fprintln(logs, "LOG:  earlier test")
+
+	mark := logs.len()
+	fmt.Fprintln(logs, "ERROR:  relation \"t\" does not exist")
+
+	passed := &fakeTB{TB: t}
+	logFailure(passed, logs, mark)
+
+	if len(passed.logs) > 0 {
+		t.Fatalf("passing test logged %q", passed.logs)
+	}
+
+	failed := &fakeTB{TB: t, failed: true}
+	logFailure(failed, logs, mark)
+
+	if len(failed.logs) != 1 || !strings.Contains(failed.logs[0], "relation \"t\" does not exist") ||
+		strings.Contains(failed.logs[0], "earlier test") {
+		t.Fatalf("failed test logged %q, want the output since its start", failed.logs)
+	}
+}
+
+func TestLogBufferCap(t *testing.T) {
+	logs := &logBuffer{}
+	line := strings.Repeat("x", 1023) + "\n"
+
+	for n := 0; n < 2*maxLogBuffer/len(line); n++ {
+		logs.Write([]byte(line))
+	}
+
+	if n := logs.buf.Len(); n > maxLogBuffer {
+		t.Fatalf("kept %d bytes, want at most %d", n, maxLogBuffer)
+	}
+
+	if n := logs.len(); n != 2*maxLogBuffer {
+		t.Fatalf("len %d, want every byte written %d", n, 2*maxLogBuffer)
+	}
+
+	mark := logs.len()
+	logs.Write([]byte("ERROR:  after mark\n"))
+
+	if s := logs.since(mark); s != "ERROR:  after mark\n" {
+		t.Fatalf("since mark gave %q", s)
+	}
+
+	if s := logs.since(0); !strings.HasPrefix(s, fmt.Sprintf("[%d bytes dropped]\n", maxLogBuffer+len("ERROR:  after mark\n"))) ||
+		!strings.HasSuffix(s, "ERROR:  after mark\n") {
+		t.Fatalf("since 0 gave %q...", s[:min(len(s), 64)])
+	}
+}
+
+func TestCloneForeignTemplate(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		tmpl *gpgsql.DatabaseTemplate
+	}{
+		{"nil", nil},
+		{"not from NewTemplate", &gpgsql.DatabaseTemplate{}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tb := &fakeTB{TB: t, fatal: true}
+			done := make(chan struct{})
+
+			go func() {
+				defer close(done)
+				Clone(tb, c.tmpl)
+			}()
+
+			<-done
+
+			if !tb.failed || len(tb.logs) != 1 || !strings.Contains(tb.logs[0], "template") {
+				t.Fatalf("got failed %t and %q, want a fatal error", tb.failed, tb.logs)
+			}
+		})
+	}
+}
+
+// ephemeralDirs returns the data directories of ephemeral servers
+// of this process.
+func ephemeralDirs(t *testing.T) []string {
+	t.Helper()
+
+	dirs, e := filepath.Glob(filepath.Join(os.TempDir(), fmt.Sprintf("gpgsql-ephemeral-%d-*", os.Getpid())))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	return dirs
+}
+
+func TestNew(t *testing.T) {
+	skipWithoutPostgres(t)
+
+	before := len(ephemeralDirs(t))
+
+	for _, failed := range []bool{false, true} {
+		tb := &fakeTB{TB: t, failed: failed}
+
+		db, dsn := New(tb)
+
+		var n int
+		if e := db.QueryRow("SELECT 1").Scan(&n); e != nil || n != 1 {
+			t.Fatalf("SELECT 1 = %d: %v", n, e)
+		}
+
+		other, e := sql.Open("postgres", dsn)
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		if e := other.Ping(); e != nil {
+			t.Fatalf("DSN %s: %s", dsn, e.Error())
+		}
+
+		if len(ephemeralDirs(t)) != before+1 {
+			t.Fatalf("%d data directories, want %d", len(ephemeralDirs(t)), before+1)
+		}
+
+		tb.cleanup()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		e = other.PingContext(ctx)
+		cancel()
+		other.Close()
+
+		if e == nil {
+			t.Fatal("server still running after cleanup")
+		}
+
+		if len(ephemeralDirs(t)) != before {
+			t.Fatal("data directory left after cleanup")
+		}
+
+		// the server log reaches tb.Log of failed tests only
+		if failed != (len(tb.logs) > 0) {
+			t.Fatalf("failed %t logged %q", failed, tb.logs)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	skipWithoutPostgres(t)
+
+	tmpl := NewTemplate(t, "gpgsqltest_clone", &gpgsql.DatabaseTemplateOptions{
+		Migrate: func(ctx context.Context, db *sql.DB) error {
+			_, e := db.ExecContext(ctx, "CREATE TABLE t (id int)")
+			return e
+		},
+	})
+
+	var dsn string
+
+	t.Run("clone", func(t *testing.T) {
+		var db *sql.DB
+		db, dsn = Clone(t, tmpl)
+
+		if _, e := db.Exec("INSERT INTO t VALUES (1)"); e != nil {
+			t.Fatal(e)
+		}
+	})
+
+	// dropped by the cleanup of the subtest
+	db, e := sql.Open("postgres", dsn)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer db.Close()
+
+	if e := db.Ping(); e == nil || !strings.Contains(e.Error(), "does not exist") {
+		t.Fatalf("clone after cleanup: %v", e)
+	}
+}
@@ -6,14 +6,18 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
 
 	"github.com/ClarkQAQ/gpgsql/release"
 )
 
 var (
-	initdbBinary = filepath.Join(binaryRootPath, release.InitdbBinary)
+	// auth methods initdb refuses to set up without a superuser password
+	passwordAuthMethods = map[string]bool{
+		"password":      true,
+		"md5":           true,
+		"scram-sha-256": true,
+	}
 
 	defaultInitdbOptions = &InitdbOptions{
 		Encoding:      "UTF8",
@@ -34,26 +38,31 @@ type InitdbOptions struct {
 
 func (g *GpgsqlRuntime) Initdb(ctx context.Context, opts ...*InitdbOptions) (e error) {
 	if len(opts) < 1 || opts[0] == nil {
-		opts = append(opts, defaultInitdbOptions)
+		opts = append(opts[:0], defaultInitdbOptions)
 	}
 
 	opt := opts[0]
 
-	args, e := initdbArgs(g, opt)
+	args, cleanup, e := initdbArgs(g, opt)
 	if e != nil {
 		return e
 	}
 
-	cmd := exec.CommandContext(ctx, initdbBinary, args...)
+	// the password file has to live until initdb has read it
+	defer cleanup()
+
+	cmd := exec.CommandContext(ctx, g.binary(release.InitdbBinary), args...)
 
 	hookWriter := NewHookWriter(g.logger)
 	cmd.Stdout = g.logger
 	cmd.Stderr = hookWriter
-	cmd.Dir = binaryRootPath
+	cmd.Dir = g.binaryDir
+
+	defer g.flushLogger()
 
 	if e := cmd.Run(); e != nil {
 		if e := hookWriter.Error(); e != nil {
-			return fmt.Errorf("stderr: %s", e.Error())
+			return fmt.Errorf("stderr: %w", e)
 		}
 
 		if cmd.ProcessState != nil && !cmd.ProcessState.Success() {
@@ -66,51 +75,88 @@ func (g *GpgsqlRuntime) Initdb(ctx context.Context, opts ...*InitdbOptions) (e e
 	return nil
 }
 
-func initdbArgs(g *GpgsqlRuntime, opt *InitdbOptions) ([]string, error) {
-	args := []string{
-		"--pgdata", g.data,
-		"--username", g.username,
-	}
+// initdbArgs translates opt into initdb arguments, every option maps to
+// its own flag. cleanup removes the password file and must be called
+// once initdb has exited.
+func initdbArgs(g *GpgsqlRuntime, opt *InitdbOptions) (args []string, cleanup func(), e error) {
+	cleanup = func() {}
 
 	switch {
 	case strings.TrimSpace(g.data) == "":
-		return nil, errors.New("data directory is empty")
+		return nil, cleanup, errors.New("data directory is empty")
 	case strings.TrimSpace(g.username) == "":
-		return nil, errors.New("username is empty")
-	case strings.TrimSpace(g.password) != "":
-		f, e := os.CreateTemp(os.TempDir(), "*")
-		if e != nil {
-			return nil, fmt.Errorf("failed to create temp file: %s", e.Error())
-		}
+		return nil, cleanup, errors.New("username is empty")
+	case opt.NoLocale && strings.TrimSpace(opt.Locale) != "":
+		return nil, cleanup, errors.New("NoLocale and Locale are mutually exclusive")
+	case passwordAuthMethods[opt.AuthMethod] && g.password == "":
+		return nil, cleanup, fmt.Errorf("auth method %s requires a password", opt.AuthMethod)
+	}
 
-		defer os.Remove(f.Name())
+	args = []string{
+		"--pgdata", g.data,
+		"--username", g.username,
+	}
 
-		if _, e := f.WriteString(g.password); e != nil {
-			return nil, fmt.Errorf("failed to write password to temp file: %s", e.Error())
+	if g.password != "" {
+		pwfile, e := writePasswordFile(g.password)
+		if e != nil {
+			return nil, cleanup, e
 		}
 
-		args = append(args, "--pwfile", f.Name())
-		fallthrough
-	case strings.TrimSpace(opt.Encoding) != "":
+		cleanup = func() { os.Remove(pwfile) }
+		args = append(args, "--pwfile", pwfile)
+	}
+
+	if strings.TrimSpace(opt.Encoding) != "" {
 		args = append(args, "--encoding", opt.Encoding)
-		fallthrough
-	case opt.NoLocale:
+	}
+
+	if opt.NoLocale {
 		args = append(args, "--no-locale")
-		fallthrough
-	case strings.TrimSpace(opt.Locale) != "":
+	}
+
+	if strings.TrimSpace(opt.Locale) != "" {
 		args = append(args, "--locale", opt.Locale)
-		fallthrough
-	case strings.TrimSpace(opt.AuthMethod) != "":
+	}
+
+	if strings.TrimSpace(opt.AuthMethod) != "" {
 		args = append(args, "--auth", opt.AuthMethod)
-		fallthrough
-	case opt.DataChecksums:
+	}
+
+	if opt.DataChecksums {
 		args = append(args, "--data-checksums")
-		fallthrough
-	case strings.TrimSpace(opt.TextSearchConfig) != "":
+	}
+
+	if strings.TrimSpace(opt.TextSearchConfig) != "" {
 		args = append(args, "--text-search-config", opt.TextSearchConfig)
 	}
 
 	args = append(args, opt.Args...)
 
-	return args, nil
+	return args, cleanup, nil
+}
+
+// writePasswordFile writes password to a temp file only the
+// current user can read.
+func writePasswordFile(password string) (string, error) {
+	f, e := os.CreateTemp(os.TempDir(), "gpgsql-pwfile-*")
+	if e != nil {
+		return "", fmt.Errorf("failed to create password file: %s", e.Error())
+	}
+
+	if e := func() error {
+		defer f.Close()
+
+		if e := f.Chmod(0600); e != nil {
+			return e
+		}
+
+		_, e := f.WriteString(password)
+		return e
+	}(); e != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write password file: %s", e.Error())
+	}
+
+	return f.Name(), nil
 }
@@ -0,0 +1,142 @@
+package gpgsql
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestInitdbArgs(t *testing.T) {
+	g := &GpgsqlRuntime{data: "/data", username: "postgres"}
+
+	args, cleanup, e := initdbArgs(g, &InitdbOptions{
+		Encoding:         "UTF8",
+		Locale:           "C",
+		AuthMethod:       "trust",
+		TextSearchConfig: "english",
+		DataChecksums:    true,
+		Args:             []string{"--no-sync"},
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer cleanup()
+
+	want := []string{
+		"--pgdata", "/data",
+		"--username", "postgres",
+		"--encoding", "UTF8",
+		"--locale", "C",
+		"--auth", "trust",
+		"--data-checksums",
+		"--text-search-config", "english",
+		"--no-sync",
+	}
+
+	if !reflect.DeepEqual(args, want) {
+		t.Fatalf("got %q, want %q", args, want)
+	}
+
+	if args, _, _ := initdbArgs(g, &InitdbOptions{NoLocale: true}); !reflect.DeepEqual(args, []string{"--pgdata", "/data", "--username", "postgres", "--no-locale"}) {
+		t.Fatalf("NoLocale gave %q", args)
+	}
+}
+
+func TestInitdbArgsPassword(t *testing.T) {
+	g := &GpgsqlRuntime{data: "/data", username: "postgres", password: "secret"}
+
+	args, cleanup, e := initdbArgs(g, &InitdbOptions{AuthMethod: "scram-sha-256"})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if len(args) != 8 || args[4] != "--pwfile" || args[6] != "--auth" || args[7] != "scram-sha-256" {
+		t.Fatalf("got %q", args)
+	}
+
+	pwfile := args[5]
+
+	b, e := os.ReadFile(pwfile)
+	if e != nil || string(b) != "secret" {
+		t.Fatalf("password file holds %q: %v", b, e)
+	}
+
+	if f, e := os.Stat(pwfile); runtime.GOOS != "windows" && (e != nil || f.Mode().Perm() != 0600) {
+		t.Fatalf("password file is %v: %v", f.Mode(), e)
+	}
+
+	cleanup()
+
+	if _, e := os.Stat(pwfile); !os.IsNotExist(e) {
+		t.Fatalf("password file left after cleanup: %v", e)
+	}
+}
+
+func TestInitdbArgsInvalid(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		g    *GpgsqlRuntime
+		opt  *InitdbOptions
+		want string
+	}{
+		{"data", &GpgsqlRuntime{username: "postgres"}, &InitdbOptions{}, "data directory is empty"},
+		{"username", &GpgsqlRuntime{data: "/data"}, &InitdbOptions{}, "username is empty"},
+		{"locale", &GpgsqlRuntime{data: "/data", username: "postgres"}, &InitdbOptions{NoLocale: true, Locale: "C"}, "NoLocale and Locale are mutually exclusive"},
+		{"password", &GpgsqlRuntime{data: "/data", username: "postgres"}, &InitdbOptions{AuthMethod: "md5"}, "auth method md5 requires a password"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if _, _, e := initdbArgs(c.g, c.opt); e == nil || e.Error() != c.want {
+				t.Fatalf("got error %v, want %q", e, c.want)
+			}
+		})
+	}
+}
+
+func TestInitdbPasswordAuth(t *testing.T) {
+	g := testRuntime(t)
+
+	// keeps the password file apart from other processes
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	t.Setenv("TMP", tmp)
+	t.Setenv("TEMP", tmp)
+
+	// Data only creates relative paths
+	if e := g.Data(t.TempDir()); e != nil {
+		t.Fatal(e)
+	}
+
+	g.Password("secret")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if e := g.Initdb(ctx, &InitdbOptions{Encoding: "UTF8", NoLocale: true, AuthMethod: "scram-sha-256"}); e != nil {
+		t.Fatal(e)
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(tmp, "gpgsql-pwfile-*")); len(files) > 0 {
+		t.Fatalf("password file left after Initdb: %q", files)
+	}
+
+	i, e := g.Daemon(ctx)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer i.Stop(context.Background(), ShutdownFast)
+
+	if e := g.CheckConnection(ctx); e != nil {
+		t.Fatalf("right password: %s", e.Error())
+	}
+
+	g.Password("wrong")
+
+	if e := g.CheckConnection(ctx); !errors.Is(e, ErrAuthentication) {
+		t.Fatalf("wrong password gave %v, want %v", e, ErrAuthentication)
+	}
+}
@@ -0,0 +1,163 @@
+package gpgsql
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	DataMissing         DataState = iota // directory does not exist
+	DataEmpty                            // nothing but ignorable entries
+	DataCluster                          // complete cluster of the release major version
+	DataPartial                          // cluster files missing, e.g. an interrupted initdb
+	DataVersionMismatch                  // cluster of another major version than ReleaseVersion
+	DataUnknown                          // not empty, but not a cluster either
+)
+
+var (
+	dataStates = []string{"missing", "empty", "cluster", "partial", "version mismatch", "unknown"}
+
+	// entries created by file managers, filesystems and users, not by
+	// initdb, only junkDataEntries are ever removed
+	ignoredDataEntries = map[string]bool{
+		".DS_Store":   true,
+		"._.DS_Store": true,
+		"Thumbs.db":   true,
+		"desktop.ini": true,
+		"lost+found":  true,
+		".gitkeep":    true,
+	}
+
+	// files file managers drop into every directory they show
+	junkDataEntries = map[string]bool{
+		".DS_Store":   true,
+		"._.DS_Store": true,
+		"Thumbs.db":   true,
+		"desktop.ini": true,
+	}
+
+	// entries every complete cluster has
+	clusterEntries = []string{"PG_VERSION", "global/pg_control", "base"}
+)
+
+type DataState uint8
+
+func (s DataState) String() string {
+	if len(dataStates) <= int(s) {
+		return ""
+	}
+
+	return dataStates[s]
+}
+
+type DataInfo struct {
+	State   DataState
+	Version string   // major version from PG_VERSION, empty without it
+	Missing []string // cluster entries that are missing
+}
+
+// InspectData reports what the data directory holds, so callers can
+// decide to init, repair, refuse or upgrade it. A DataEmpty directory
+// may still hold entries like .DS_Store, lost+found or .gitkeep, which
+// initdb refuses, the caller must deal with them before running initdb,
+// see EnsureReady.
+func (g *GpgsqlRuntime) InspectData() (*DataInfo, error) {
+	if strings.TrimSpace(g.data) == "" {
+		return nil, errors.New("data directory is empty")
+	}
+
+	f, e := os.Stat(g.data)
+	if errors.Is(e, os.ErrNotExist) {
+		return &DataInfo{State: DataMissing, Missing: clusterEntries}, nil
+	}
+
+	if e != nil {
+		return nil, e
+	}
+
+	if !f.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", g.data)
+	}
+
+	entries, e := os.ReadDir(g.data)
+	if e != nil {
+		return nil, e
+	}
+
+	empty := true
+	for _, entry := range entries {
+		if !ignoredDataEntries[entry.Name()] {
+			empty = false
+			break
+		}
+	}
+
+	if empty {
+		return &DataInfo{State: DataEmpty, Missing: clusterEntries}, nil
+	}
+
+	info := &DataInfo{}
+
+	if b, e := os.ReadFile(filepath.Join(g.data, "PG_VERSION")); e == nil {
+		info.Version = strings.TrimSpace(string(b))
+	}
+
+	for _, name := range clusterEntries {
+		if _, e := os.Stat(filepath.Join(g.data, name)); e != nil {
+			info.Missing = append(info.Missing, name)
+		}
+	}
+
+	switch {
+	case info.Version != "" && info.Version != majorVersion(g.version):
+		info.State = DataVersionMismatch
+	case len(info.Missing) < 1:
+		info.State = DataCluster
+	case len(info.Missing) < len(clusterEntries):
+		info.State = DataPartial
+	default:
+		info.State = DataUnknown
+	}
+
+	return info, nil
+}
+
+// removeJunkEntries removes the junk files of file managers from the
+// data directory, initdb refuses a directory holding any entry. Every
+// other entry belongs to the user and fails instead, lost+found means
+// the directory is the root of a filesystem.
+func (g *GpgsqlRuntime) removeJunkEntries() error {
+	entries, e := os.ReadDir(g.data)
+	if e != nil {
+		if errors.Is(e, os.ErrNotExist) {
+			return nil
+		}
+
+		return e
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		switch {
+		case name == "lost+found":
+			return fmt.Errorf("data directory %s holds lost+found, it looks like a mount point, use a subdirectory of it", g.data)
+		case !junkDataEntries[name]:
+			return fmt.Errorf("data directory %s holds %s, remove it or use another directory", g.data, name)
+		case !entry.Type().IsRegular():
+			return fmt.Errorf("data directory %s holds %s, which is not a regular file", g.data, name)
+		}
+	}
+
+	// only once every entry is known junk, nothing is removed otherwise
+	for _, entry := range entries {
+		if e := os.Remove(filepath.Join(g.data, entry.Name())); e != nil {
+			return fmt.Errorf("failed to remove %s: %s", entry.Name(), e.Error())
+		}
+	}
+
+	return nil
+}
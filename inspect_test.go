@@ -0,0 +1,121 @@
+package gpgsql
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInspectData(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		files   map[string]string // relative path to content, directories end with /
+		missing bool
+		want    DataState
+		version string
+		lacking []string
+	}{
+		{"missing", nil, true, DataMissing, "", clusterEntries},
+		{"empty", nil, false, DataEmpty, "", clusterEntries},
+		{"ignorable", map[string]string{".DS_Store": "", "lost+found/": "", ".gitkeep": ""}, false, DataEmpty, "", clusterEntries},
+		{"cluster", map[string]string{"PG_VERSION": "14\n", "global/pg_control": "", "base/": ""}, false, DataCluster, "14", nil},
+		{"partial", map[string]string{"PG_VERSION": "14\n", "base/": ""}, false, DataPartial, "14", []string{"global/pg_control"}},
+		{"version mismatch", map[string]string{"PG_VERSION": "9.6\n", "global/pg_control": "", "base/": ""}, false, DataVersionMismatch, "9.6", nil},
+		{"unknown", map[string]string{"notes.txt": "hello"}, false, DataUnknown, "", clusterEntries},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			data := filepath.Join(t.TempDir(), "data")
+
+			if !c.missing {
+				if e := os.Mkdir(data, PostgresqlDataPerm); e != nil {
+					t.Fatal(e)
+				}
+			}
+
+			for name, content := range c.files {
+				path := filepath.Join(data, name)
+
+				if name[len(name)-1] == '/' {
+					if e := os.MkdirAll(path, 0700); e != nil {
+						t.Fatal(e)
+					}
+
+					continue
+				}
+
+				if e := os.MkdirAll(filepath.Dir(path), 0700); e != nil {
+					t.Fatal(e)
+				}
+
+				if e := os.WriteFile(path, []byte(content), 0600); e != nil {
+					t.Fatal(e)
+				}
+			}
+
+			info, e := (&GpgsqlRuntime{data: data, version: "14.5"}).InspectData()
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			if info.State != c.want || info.Version != c.version || !reflect.DeepEqual(info.Missing, c.lacking) {
+				t.Fatalf("got %s version %q missing %q, want %s version %q missing %q",
+					info.State, info.Version, info.Missing, c.want, c.version, c.lacking)
+			}
+		})
+	}
+
+	if _, e := (&GpgsqlRuntime{}).InspectData(); e == nil {
+		t.Fatal("no error without data directory")
+	}
+
+	file := filepath.Join(t.TempDir(), "file")
+	if e := os.WriteFile(file, nil, 0600); e != nil {
+		t.Fatal(e)
+	}
+
+	if _, e := (&GpgsqlRuntime{data: file}).InspectData(); e == nil {
+		t.Fatal("no error for a data directory that is a file")
+	}
+}
+
+// IsEmptyData keeps its semantics from before InspectData
+func TestIsEmptyData(t *testing.T) {
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "file")
+	if e := os.WriteFile(file, nil, 0600); e != nil {
+		t.Fatal(e)
+	}
+
+	junk := filepath.Join(dir, "junk")
+	if e := os.MkdirAll(junk, 0700); e != nil {
+		t.Fatal(e)
+	}
+
+	if e := os.WriteFile(filepath.Join(junk, ".DS_Store"), nil, 0600); e != nil {
+		t.Fatal(e)
+	}
+
+	empty := filepath.Join(dir, "empty")
+	if e := os.MkdirAll(empty, 0700); e != nil {
+		t.Fatal(e)
+	}
+
+	for _, c := range []struct {
+		data  string
+		empty bool
+		err   bool
+	}{
+		{filepath.Join(dir, "missing"), false, true},
+		{file, false, false},
+		{junk, false, false},
+		{empty, true, false},
+	} {
+		empty, e := (&GpgsqlRuntime{data: c.data}).IsEmptyData()
+
+		if empty != c.empty || (e != nil) != c.err {
+			t.Fatalf("%s: got %t and %v, want %t and error %t", filepath.Base(c.data), empty, e, c.empty, c.err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package gpgsql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// poll interval of servers that are not our child process
+	processPollInterval = 500 * time.Millisecond
+)
+
+// Instance is a running postgres server, started by Start or Daemon.
+type Instance struct {
+	g        *GpgsqlRuntime
+	proc     *process // nil when pg_ctl started the server
+	pid      int
+	host     net.IP
+	socket   string
+	port     uint16
+	username string
+	password string
+
+	done    chan struct{}
+	err     error
+	mu      sync.Mutex
+	stopped bool
+}
+
+func (g *GpgsqlRuntime) newInstance(pid int) *Instance {
+	return &Instance{
+		g:        g,
+		pid:      pid,
+		host:     g.host,
+		socket:   g.socket,
+		port:     g.port,
+		username: g.username,
+		password: g.password,
+		done:     make(chan struct{}),
+	}
+}
+
+// newProcessInstance wraps a postmaster started by Daemon.
+func (g *GpgsqlRuntime) newProcessInstance(p *process) *Instance {
+	i := g.newInstance(p.pid())
+	i.proc = p
+
+	go func() {
+		<-p.done
+		i.finish(p.exitError())
+	}()
+
+	return i
+}
+
+// newExternalInstance wraps a postmaster that is not our child
+// process, its exit is noticed by polling the pid.
+func (g *GpgsqlRuntime) newExternalInstance(pid int) *Instance {
+	i := g.newInstance(pid)
+
+	go func() {
+		ticker := time.NewTicker(processPollInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if !processAlive(pid) {
+				i.finish(errors.New("postgres exited unexpectedly"))
+				return
+			}
+		}
+	}()
+
+	return i
+}
+
+func (i *Instance) finish(e error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.stopped && i.proc == nil {
+		e = nil
+	}
+
+	i.err = e
+	close(i.done)
+}
+
+// Stop shuts the server down in the given mode and waits for it to exit,
+// an empty mode means fast. The ctx deadline bounds the shutdown. The
+// data directory of an ephemeral runtime is removed afterwards.
+func (i *Instance) Stop(ctx context.Context, mode ShutdownMode) error {
+	e := i.stop(ctx, mode)
+
+	// done of a Daemon instance is closed right after the process
+	// exits, but by another goroutine
+	if i.proc != nil {
+		select {
+		case <-i.proc.done:
+			<-i.done
+		default:
+		}
+	}
+
+	select {
+	case <-i.done:
+		if re := i.g.removeEphemeral(); re != nil && e == nil {
+			e = re
+		}
+	default:
+	}
+
+	return e
+}
+
+func (i *Instance) stop(ctx context.Context, mode ShutdownMode) error {
+	if mode == "" {
+		mode = ShutdownFast
+	}
+
+	if e := mode.valid(); e != nil {
+		return e
+	}
+
+	i.mu.Lock()
+	i.stopped = true
+	i.mu.Unlock()
+
+	if i.proc != nil {
+		return i.proc.shutdown(ctx, mode)
+	}
+
+	select {
+	case <-i.done:
+		return i.err
+	default:
+	}
+
+	opt := &PgCliOptions{
+		Wait: true,
+		Mode: string(mode),
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		opt.Timeout = int(math.Ceil(time.Until(deadline).Seconds()))
+	}
+
+	if e := i.g.PgCli(ctx, CliStop, opt); e != nil {
+		return fmt.Errorf("failed to stop postgres: %s", e.Error())
+	}
+
+	select {
+	case <-i.done:
+		return i.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Wait blocks until the server has exited and returns Err.
+func (i *Instance) Wait() error {
+	<-i.done
+	return i.err
+}
+
+func (i *Instance) PID() int {
+	return i.pid
+}
+
+// DSN returns the connection string of the database named after the user.
+func (i *Instance) DSN() string {
+	return dsn(i.host, i.socket, i.port, i.username, i.password, i.username)
+}
+
+func (i *Instance) ListenAddr() string {
+	return listenAddr(i.host, i.socket, i.port)
+}
+
+// Done is closed once the server has exited.
+func (i *Instance) Done() <-chan struct{} {
+	return i.done
+}
+
+// Err returns nil while the server is running, and after it exited the
+// exit status, or nil if it exited cleanly through Stop.
+func (i *Instance) Err() error {
+	select {
+	case <-i.done:
+		return i.err
+	default:
+		return nil
+	}
+}
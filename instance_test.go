@@ -0,0 +1,144 @@
+package gpgsql
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStopRemovesEphemeral(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stands in for postgres with sleep")
+	}
+
+	for n := 0; n < 20; n++ {
+		g := &GpgsqlRuntime{data: t.TempDir(), ephemeral: true}
+
+		p, e := g.startProcess(exec.Command("sleep", "10"), nil)
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		// sleep exits on the fast shutdown signal
+		g.newProcessInstance(p).Stop(context.Background(), ShutdownFast)
+
+		if _, e := os.Stat(g.data); !os.IsNotExist(e) {
+			t.Fatalf("data directory left after Stop: %v", e)
+		}
+	}
+}
+
+// sleepInstance wraps a sleep process like Daemon wraps a postmaster.
+func sleepInstance(t *testing.T, g *GpgsqlRuntime) (*Instance, *process) {
+	t.Helper()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("stands in for postgres with sleep")
+	}
+
+	p, e := g.startProcess(exec.Command("sleep", "60"), nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	t.Cleanup(func() {
+		p.cmd.Process.Kill()
+		<-p.done
+	})
+
+	return g.newProcessInstance(p), p
+}
+
+func TestInstanceUnexpectedExit(t *testing.T) {
+	i, p := sleepInstance(t, &GpgsqlRuntime{})
+
+	select {
+	case <-i.Done():
+		t.Fatal("done while running")
+	default:
+	}
+
+	if e := i.Err(); e != nil {
+		t.Fatalf("error while running: %s", e.Error())
+	}
+
+	if e := p.cmd.Process.Kill(); e != nil {
+		t.Fatal(e)
+	}
+
+	select {
+	case <-i.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("done not closed after the process exited")
+	}
+
+	e := i.Err()
+	if e == nil || !strings.Contains(e.Error(), "exited") {
+		t.Fatalf("got %v, want the exit status", e)
+	}
+
+	if we := i.Wait(); we != e {
+		t.Fatalf("Wait gave %v, Err %v", we, e)
+	}
+}
+
+func TestInstanceStopTwice(t *testing.T) {
+	i, _ := sleepInstance(t, &GpgsqlRuntime{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	e := i.Stop(ctx, ShutdownFast)
+
+	select {
+	case <-i.Done():
+	default:
+		t.Fatal("done not closed after Stop")
+	}
+
+	// the second call neither signals nor waits again
+	if again := i.Stop(ctx, ShutdownImmediate); again != e {
+		t.Fatalf("second Stop gave %v, want %v", again, e)
+	}
+
+	if we := i.Wait(); we != i.Err() {
+		t.Fatalf("Wait gave %v, Err %v", we, i.Err())
+	}
+}
+
+func TestInstanceAddr(t *testing.T) {
+	g := &GpgsqlRuntime{host: net.IP{127, 0, 0, 1}, port: 5433, username: "postgres"}
+	i, p := sleepInstance(t, g)
+
+	if i.PID() != p.pid() || i.PID() < 1 {
+		t.Fatalf("pid %d, want %d", i.PID(), p.pid())
+	}
+
+	if addr := i.ListenAddr(); addr != "127.0.0.1:5433" {
+		t.Fatalf("listen address %s, want 127.0.0.1:5433", addr)
+	}
+
+	// later changes to the runtime do not move the instance
+	g.port = 5434
+
+	if addr := i.ListenAddr(); addr != "127.0.0.1:5433" {
+		t.Fatalf("listen address %s after the runtime moved", addr)
+	}
+
+	if dsn := i.DSN(); !strings.Contains(dsn, "5433") {
+		t.Fatalf("dsn %s, want port 5433", dsn)
+	}
+
+	socket := &GpgsqlRuntime{socket: "/tmp", port: 5433}
+	i, _ = sleepInstance(t, socket)
+
+	if addr := i.ListenAddr(); addr != filepath.Join("/tmp", ".s.PGSQL.5433") {
+		t.Fatalf("listen address %s, want the socket", addr)
+	}
+}
@@ -0,0 +1,236 @@
+package gpgsql
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SeverityUnknown LogSeverity = iota // not a postgres log line, e.g. initdb output
+	SeverityDebug
+	SeverityInfo
+	SeverityNotice
+	SeverityWarning
+	SeverityError
+	SeverityLog
+	SeverityFatal
+	SeverityPanic
+)
+
+var (
+	// ordered like postgres does for the server log
+	logSeverities = []string{"", "DEBUG", "INFO", "NOTICE", "WARNING", "ERROR", "LOG", "FATAL", "PANIC"}
+
+	// supplementary lines belonging to the previous message
+	logFields = map[string]bool{
+		"DETAIL":    true,
+		"HINT":      true,
+		"QUERY":     true,
+		"CONTEXT":   true,
+		"LOCATION":  true,
+		"STATEMENT": true,
+	}
+
+	// default log_line_prefix "%m [%p] " of postgres 13+, older
+	// versions log without prefix
+	logLinePattern = regexp.MustCompile(
+		`^(?:(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?)(?: ([A-Za-z0-9+\-:/_]+))? )?(?:\[(\d+)\] )?([A-Z]+[1-5]?):  (.*)$`)
+
+	logTimeLayouts = []string{"2006-01-02 15:04:05.999999 -07", "2006-01-02 15:04:05.999999 MST", "2006-01-02 15:04:05.999999"}
+
+	slogLevels = map[LogSeverity]slog.Level{
+		SeverityDebug:   slog.LevelDebug,
+		SeverityInfo:    slog.LevelInfo,
+		SeverityNotice:  slog.LevelInfo,
+		SeverityWarning: slog.LevelWarn,
+		SeverityError:   slog.LevelError,
+		SeverityLog:     slog.LevelInfo,
+		SeverityFatal:   slog.LevelError + 4,
+		SeverityPanic:   slog.LevelError + 8,
+	}
+)
+
+type LogSeverity uint8
+
+func (s LogSeverity) String() string {
+	if len(logSeverities) <= int(s) {
+		return ""
+	}
+
+	return logSeverities[s]
+}
+
+// LogRecord is one line of child process output.
+type LogRecord struct {
+	Time     time.Time   // zero when the line has no timestamp
+	PID      int         // zero when the line has no pid
+	Severity LogSeverity // inherited by supplementary and continuation lines
+	Field    string      // "DETAIL", "HINT", ... for supplementary lines, empty otherwise
+	Message  string      // message without prefix and severity
+	Raw      string      // the whole line
+}
+
+type LogSink interface {
+	Log(rec *LogRecord)
+}
+
+type LogSinkFunc func(rec *LogRecord)
+
+func (f LogSinkFunc) Log(rec *LogRecord) {
+	f(rec)
+}
+
+// MinSeverity drops records below min before they reach sink,
+// unknown lines are always passed.
+func MinSeverity(min LogSeverity, sink LogSink) LogSink {
+	return LogSinkFunc(func(rec *LogRecord) {
+		if rec.Severity == SeverityUnknown || rec.Severity >= min {
+			sink.Log(rec)
+		}
+	})
+}
+
+// LogWriter splits the output of postgres, initdb and pg_ctl into
+// lines and passes the parsed records to a sink.
+type LogWriter struct {
+	*lineWriter
+
+	sink LogSink
+	last LogRecord // previous record, for supplementary lines
+}
+
+func NewLogWriter(sink LogSink) *LogWriter {
+	w := &LogWriter{sink: sink}
+	w.lineWriter = newLineWriter(w.line)
+	return w
+}
+
+func (w *LogWriter) line(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+
+	rec := ParseLogLine(line, &w.last)
+	w.last = *rec
+
+	w.sink.Log(rec)
+}
+
+// ParseLogLine parses a postgres log line, prev is the previous record
+// of the stream and may be nil.
+func ParseLogLine(line string, prev *LogRecord) *LogRecord {
+	rec := &LogRecord{Raw: line, Message: line}
+
+	m := logLinePattern.FindStringSubmatch(line)
+	if m == nil {
+		// continuation lines of multi-line messages are tab indented
+		if prev != nil && strings.HasPrefix(line, "\t") {
+			rec.Time, rec.PID, rec.Severity, rec.Field = prev.Time, prev.PID, prev.Severity, prev.Field
+			rec.Message = strings.TrimPrefix(line, "\t")
+		}
+
+		return rec
+	}
+
+	rec.Message = m[5]
+
+	if m[1] != "" {
+		value := m[1]
+		if m[2] != "" {
+			value += " " + m[2]
+		}
+
+		for _, layout := range logTimeLayouts {
+			if t, e := time.Parse(layout, value); e == nil {
+				rec.Time = t
+				break
+			}
+		}
+	}
+
+	if m[3] != "" {
+		rec.PID, _ = strconv.Atoi(m[3])
+	}
+
+	severity := m[4]
+
+	if logFields[severity] {
+		rec.Field = severity
+		if prev != nil {
+			rec.Severity = prev.Severity
+		}
+
+		return rec
+	}
+
+	if strings.HasPrefix(severity, "DEBUG") {
+		severity = "DEBUG"
+	}
+
+	for i, name := range logSeverities {
+		if i > 0 && name == severity {
+			rec.Severity = LogSeverity(i)
+			return rec
+		}
+	}
+
+	// not a severity after all, keep the line as it is
+	return &LogRecord{Raw: line, Message: line}
+}
+
+// LogSink routes the output of every child process through sink
+// instead of a raw writer, it replaces Logger.
+func (g *GpgsqlRuntime) LogSink(sink LogSink) *GpgsqlRuntime {
+	g.logger = NewLogWriter(sink)
+	return g
+}
+
+// flushLogger passes the last line of a child process that exited
+// without a trailing newline on to the sink.
+func (g *GpgsqlRuntime) flushLogger() {
+	if w, ok := g.logger.(*LogWriter); ok {
+		w.Flush()
+	}
+}
+
+// NewSlogSink passes records to a log/slog handler, FATAL and PANIC
+// are logged above slog.LevelError.
+func NewSlogSink(h slog.Handler) LogSink {
+	return LogSinkFunc(func(rec *LogRecord) {
+		ctx := context.Background()
+
+		level, ok := slogLevels[rec.Severity]
+		if !ok {
+			level = slog.LevelInfo
+		}
+
+		if !h.Enabled(ctx, level) {
+			return
+		}
+
+		t := rec.Time
+		if t.IsZero() {
+			t = time.Now()
+		}
+
+		r := slog.NewRecord(t, level, rec.Message, 0)
+
+		if rec.Severity != SeverityUnknown {
+			r.AddAttrs(slog.String("severity", rec.Severity.String()))
+		}
+
+		if rec.Field != "" {
+			r.AddAttrs(slog.String("field", rec.Field))
+		}
+
+		if rec.PID > 0 {
+			r.AddAttrs(slog.Int("pid", rec.PID))
+		}
+
+		h.Handle(ctx, r)
+	})
+}
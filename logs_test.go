@@ -0,0 +1,149 @@
+package gpgsql
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/ClarkQAQ/gpgsql/release"
+)
+
+func TestParseLogLine(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		want LogRecord
+	}{
+		{
+			"2022-08-11 10:00:00.123 UTC [4242] LOG:  database system is ready to accept connections",
+			LogRecord{
+				Time:     time.Date(2022, 8, 11, 10, 0, 0, 123000000, time.UTC),
+				PID:      4242,
+				Severity: SeverityLog,
+				Message:  "database system is ready to accept connections",
+			},
+		},
+		{
+			"2022-08-11 10:00:00 +08 [7] FATAL:  role \"x\" does not exist",
+			LogRecord{
+				Time:     time.Date(2022, 8, 11, 10, 0, 0, 0, time.FixedZone("", 8*60*60)),
+				PID:      7,
+				Severity: SeverityFatal,
+				Message:  "role \"x\" does not exist",
+			},
+		},
+		{
+			"LOG:  database system was shut down at 2022-08-11 10:00:00 UTC",
+			LogRecord{Severity: SeverityLog, Message: "database system was shut down at 2022-08-11 10:00:00 UTC"},
+		},
+		{
+			"DEBUG3:  checkpoint record is at 0/1000028",
+			LogRecord{Severity: SeverityDebug, Message: "checkpoint record is at 0/1000028"},
+		},
+		{
+			"WARNING:  could not flush dirty data",
+			LogRecord{Severity: SeverityWarning, Message: "could not flush dirty data"},
+		},
+		{
+			"The files belonging to this database system will be owned by user \"postgres\".",
+			LogRecord{Message: "The files belonging to this database system will be owned by user \"postgres\"."},
+		},
+		{
+			"NOTE:  not a severity",
+			LogRecord{Message: "NOTE:  not a severity"},
+		},
+	} {
+		rec := ParseLogLine(c.line, nil)
+
+		c.want.Raw = c.line
+
+		if !rec.Time.Equal(c.want.Time) {
+			t.Errorf("%q: time %s, want %s", c.line, rec.Time, c.want.Time)
+		}
+
+		rec.Time, c.want.Time = time.Time{}, time.Time{}
+
+		if !reflect.DeepEqual(*rec, c.want) {
+			t.Errorf("%q: got %+v, want %+v", c.line, *rec, c.want)
+		}
+	}
+}
+
+func TestLogWriter(t *testing.T) {
+	var records []LogRecord
+
+	w := NewLogWriter(LogSinkFunc(func(rec *LogRecord) {
+		records = append(records, *rec)
+	}))
+
+	w.Write([]byte("2022-08-11 10:00:00 UTC [9] ERROR:  relation \"t\" does not exist at character 15\n"))
+	w.Write([]byte("2022-08-11 10:00:00 UTC [9] STATEMENT:  SELECT * FROM t\n\tWHERE id = 1\r\n\n"))
+	w.Write([]byte("HINT:  Perhaps you meant \"s\".\n"))
+	w.Write([]byte("LOG:  partial"))
+
+	if len(records) != 4 {
+		t.Fatalf("got %d records before Flush, want 4", len(records))
+	}
+
+	w.Flush()
+
+	want := []struct {
+		severity LogSeverity
+		field    string
+		pid      int
+		message  string
+	}{
+		{SeverityError, "", 9, "relation \"t\" does not exist at character 15"},
+		{SeverityError, "STATEMENT", 9, "SELECT * FROM t"},
+		{SeverityError, "STATEMENT", 9, "WHERE id = 1"},
+		{SeverityError, "HINT", 0, "Perhaps you meant \"s\"."},
+		{SeverityLog, "", 0, "partial"},
+	}
+
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d", len(records), len(want))
+	}
+
+	for i, w := range want {
+		rec := records[i]
+
+		if rec.Severity != w.severity || rec.Field != w.field || rec.PID != w.pid || rec.Message != w.message {
+			t.Errorf("record %d: got %s %q %d %q, want %s %q %d %q", i,
+				rec.Severity, rec.Field, rec.PID, rec.Message, w.severity, w.field, w.pid, w.message)
+		}
+	}
+}
+
+func TestPgCliFlushesLogger(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake pg_ctl is a shell script")
+	}
+
+	dir := t.TempDir()
+
+	if e := os.MkdirAll(filepath.Join(dir, filepath.Dir(release.PgCliBinary)), 0755); e != nil {
+		t.Fatal(e)
+	}
+
+	if e := os.WriteFile(filepath.Join(dir, release.PgCliBinary), []byte("#!/bin/sh\nprintf 'pg_ctl: no server running'\n"), 0755); e != nil {
+		t.Fatal(e)
+	}
+
+	var messages []string
+
+	g := &GpgsqlRuntime{data: dir, binaryDir: dir}
+	g.LogSink(LogSinkFunc(func(rec *LogRecord) {
+		messages = append(messages, rec.Message)
+	}))
+
+	if e := g.PgCli(context.Background(), CliStatus); e != nil {
+		t.Fatal(e)
+	}
+
+	if !reflect.DeepEqual(messages, []string{"pg_ctl: no server running"}) {
+		t.Fatalf("got %q", messages)
+	}
+}
@@ -3,8 +3,9 @@ package gpgsql
 import (
 	"context"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
-	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -24,9 +25,8 @@ const (
 )
 
 var (
-	pgCliBinary         string = filepath.Join(binaryRootPath, release.PgCliBinary)
-	pgCliMethods               = []string{"init", "start", "stop", "restart", "status", "reload", "promote", "logrotate", "kill"}
-	defaultPgCliOptions        = &PgCliOptions{
+	pgCliMethods        = []string{"init", "start", "stop", "restart", "status", "reload", "promote", "logrotate", "kill"}
+	defaultPgCliOptions = &PgCliOptions{
 		Wait:    true,
 		Timeout: 5,
 	}
@@ -54,7 +54,7 @@ type PgCliOptions struct {
 
 func (g *GpgsqlRuntime) PgCli(ctx context.Context, method pgCliMethod, opts ...*PgCliOptions) (e error) {
 	if len(opts) < 1 || opts[0] == nil {
-		opts = append(opts, defaultPgCliOptions)
+		opts = append(opts[:0], defaultPgCliOptions)
 	}
 
 	opt := opts[0]
@@ -94,19 +94,54 @@ func (g *GpgsqlRuntime) PgCli(ctx context.Context, method pgCliMethod, opts ...*
 		args = append(args, opt.Args...)
 	}
 
-	cmd := exec.CommandContext(ctx, pgCliBinary, args...)
+	cmd := exec.CommandContext(ctx, g.binary(release.PgCliBinary), args...)
 	hookWriter := NewHookWriter(g.logger)
 
 	cmd.Stdout = g.logger
 	cmd.Stderr = hookWriter
-	cmd.Dir = binaryRootPath
+	cmd.Dir = g.binaryDir
+
+	defer g.flushLogger()
+
+	// the server started by pg_ctl inherits its stdout and keeps it open,
+	// cmd.Run would wait for a pipe of its own until the server exits
+	var serverOutput *os.File
+
+	if _, ok := g.logger.(*os.File); !ok && g.logger != nil && (method == CliStart || method == CliRestart) {
+		r, w, e := os.Pipe()
+		if e != nil {
+			return fmt.Errorf("failed to create output pipe: %s", e.Error())
+		}
+
+		go func() {
+			defer r.Close()
+			io.Copy(g.logger, r)
+			g.flushLogger()
+		}()
+
+		cmd.Stdout, serverOutput = w, w
+	}
+
+	e = cmd.Start()
+
+	if serverOutput != nil {
+		serverOutput.Close()
+	}
+
+	if e == nil {
+		e = cmd.Wait()
+	}
+
+	if e != nil {
+		if e := hookWriter.Error(); e != nil {
+			return fmt.Errorf("stderr: %w", e)
+		}
 
-	if e := cmd.Run(); e != nil {
 		return fmt.Errorf("failed to execute command: %s", e.Error())
 	}
 
 	if e := hookWriter.Error(); e != nil {
-		return fmt.Errorf("stderr: %s", e.Error())
+		return fmt.Errorf("stderr: %w", e)
 	}
 
 	return nil
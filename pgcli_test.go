@@ -0,0 +1,81 @@
+package gpgsql
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ClarkQAQ/gpgsql/release"
+)
+
+// fakePgCli stands in for pg_ctl start, leaving a server behind that
+// writes to the inherited stdout after pg_ctl has exited. Like pg_ctl
+// it sends the stderr of the server to stdout.
+const fakePgCli = `#!/bin/sh
+echo "waiting for server to start"
+(sleep 1; echo "server output") </dev/null 2>&1 &
+echo "server started"
+`
+
+func TestPgCliStartOutputPipe(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake pg_ctl is a shell script")
+	}
+
+	dir := t.TempDir()
+
+	if e := os.MkdirAll(filepath.Join(dir, filepath.Dir(release.PgCliBinary)), 0755); e != nil {
+		t.Fatal(e)
+	}
+
+	if e := os.WriteFile(filepath.Join(dir, release.PgCliBinary), []byte(fakePgCli), 0755); e != nil {
+		t.Fatal(e)
+	}
+
+	var (
+		mu    sync.Mutex
+		lines []string
+	)
+
+	g := &GpgsqlRuntime{data: dir, binaryDir: dir}
+	g.LogSink(LogSinkFunc(func(rec *LogRecord) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		lines = append(lines, rec.Message)
+	}))
+
+	start := time.Now()
+
+	if e := g.PgCli(context.Background(), CliStart); e != nil {
+		t.Fatal(e)
+	}
+
+	// pg_ctl returned without waiting for the server holding its stdout
+	if d := time.Since(start); d > 900*time.Millisecond {
+		t.Fatalf("PgCli returned after %s", d)
+	}
+
+	// and the server output still reaches the logger
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		mu.Lock()
+		n := len(lines)
+		mu.Unlock()
+
+		if n == 3 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d lines of output, want 3", n)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -2,50 +2,81 @@ package gpgsql
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ClarkQAQ/gpgsql/release"
 )
 
+const (
+	minSharedBuffers  = 16
+	maxSharedBuffers  = 1073741823 // INT_MAX / 2
+	maxConnections    = 262143
+	maxDebugLevel     = 5
+	minWorkMem        = 64         // kB
+	maxWorkMem        = 2147483647 // kB, MAX_KILOBYTES of 64 bit builds
+	maxUnixSocketPath = 103        // sun_path of darwin, shorter than linux
+)
+
 var (
-	postgresBinary string = filepath.Join(binaryRootPath, release.PostgresBinary)
+	parameterNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_$]*(\.[a-z_][a-z0-9_$]*)?$`)
 
 	defaultPostgreSqlOptions = &PostgreSqlOptions{
-		Wait:    3 * time.Second,
 		Timeout: 5 * time.Second,
 	}
 )
 
 type GpgsqlRuntime struct {
-	host     net.IP // host address
-	port     uint16 // host port
-	username string // username
-	password string // password
-	data     string // data directory
-	logger   io.Writer
+	host      net.IP // host address
+	socket    string // unix socket directory, used when host is nil
+	port      uint16 // host port
+	username  string // username
+	password  string // password
+	data      string // data directory
+	ephemeral bool   // data directory is removed on Stop
+	logger    io.Writer
+	binaryDir string // extracted postgres binaries
+	cacheDir  string // templates and shared servers
+	version   string // postgres version of the binaries
+
+	mu       sync.Mutex // serializes EnsureReady
+	instance *Instance  // server returned by EnsureReady
 }
 
 type PostgreSqlOptions struct {
-	Nbuffers             uint64            // number of shared buffers
-	DebugLevel           uint              // debugging level
+	Nbuffers             uint64            // number of shared buffers, 8kB each
+	DebugLevel           uint              // debugging level, 0 to 5
 	DMY                  bool              // use European date input format (DMY)
 	FsyncOff             bool              // turn fsync off
 	EnableTcpConnections bool              // enable TCP/IP connections
 	UnixSocket           string            // path to Unix domain socket
 	SSL                  bool              // enable SSL connections
 	MaxConnection        uint              // maximum number of connections
-	WorkMem              uint64            // memory for query execution
-	Parma                map[string]string // set run-time parameter
+	WorkMem              uint64            // memory for query execution in kB
+	Parma                map[string]string // set run-time parameter, must not repeat a typed option
 	Args                 []string          // additional arguments
-	Wait                 time.Duration     // wait for server to start
-	Timeout              time.Duration     // timeout for check connections
+	Wait                 time.Duration     // unused, readiness is detected instead of sleeping
+	Timeout              time.Duration     // how long connection checks are retried until the server is ready
+}
+
+type RuntimeOptions struct {
+	CacheDir        string         // extracted binaries, templates and shared servers, $GPGSQL_CACHE_DIR or the user cache directory by default
+	BinaryDir       string         // pre-extracted binaries used read-only, like SystemBinary, $GPGSQL_BINARY_DIR by default
+	Provider        BinaryProvider // where the binaries come from, overrides BinaryDir, the embedded archive by default
+	Version         string         // postgres version like 14.5.0 or 14, picks the embedded one, see AvailableVersions, other binaries must match it
+	ForceDecompress bool           // extract the embedded archive again even when the extracted binaries are intact
 }
 
 func New(forceDecompressBinary ...bool) (*GpgsqlRuntime, error) {
@@ -53,19 +84,87 @@ func New(forceDecompressBinary ...bool) (*GpgsqlRuntime, error) {
 		forceDecompressBinary = append(forceDecompressBinary, false)
 	}
 
-	if e := DecompressBinary(forceDecompressBinary[0]); e != nil {
-		return nil, fmt.Errorf("failed to decompress binary: %s", e.Error())
+	return NewRuntime(&RuntimeOptions{ForceDecompress: forceDecompressBinary[0]})
+}
+
+// NewRuntime returns a runtime on the binaries of opt.Provider, by
+// default the embedded archive extracted into opt.CacheDir, or the
+// pre-extracted opt.BinaryDir which is never written to.
+func NewRuntime(opts ...*RuntimeOptions) (*GpgsqlRuntime, error) {
+	if len(opts) < 1 || opts[0] == nil {
+		opts = append(opts[:0], &RuntimeOptions{})
+	}
+
+	opt := opts[0]
+
+	cache := opt.CacheDir
+	if cache == "" {
+		cache = cacheRoot()
+	}
+
+	provider := opt.Provider
+	if provider == nil {
+		dir := opt.BinaryDir
+		if dir == "" {
+			dir = strings.TrimSpace(os.Getenv(BinaryDirEnv))
+		}
+
+		if dir != "" {
+			provider = &SystemBinary{Dir: dir}
+		} else {
+			provider = &EmbeddedBinary{Version: opt.Version, Force: opt.ForceDecompress}
+		}
+	}
+
+	binary, e := provider.Provide(context.Background(), cache)
+	if e != nil {
+		return nil, fmt.Errorf("failed to provide binary: %w", e)
+	}
+
+	var version string
+
+	if p, ok := provider.(*EmbeddedBinary); ok {
+		version = p.releaseVersion()
+	}
+
+	if version == "" {
+		if version, e = binaryVersion(binary); e != nil {
+			return nil, e
+		}
+	}
+
+	// other providers don't choose by version, but must not hand out another
+	if opt.Version != "" && !versionMatches(version, opt.Version) {
+		return nil, fmt.Errorf("binaries in %s are postgres %s, not the requested %s", binary, version, opt.Version)
 	}
 
 	return &GpgsqlRuntime{
-		host:     net.IP{127, 0, 0, 1},
-		port:     0,
-		username: "postgres",
-		password: "",
-		logger:   os.Stdout,
+		host:      net.IP{127, 0, 0, 1},
+		port:      0,
+		username:  "postgres",
+		password:  "",
+		logger:    os.Stdout,
+		binaryDir: binary,
+		cacheDir:  cache,
+		version:   version,
 	}, nil
 }
 
+// binary returns the path of a program of the release.
+func (g *GpgsqlRuntime) binary(name string) string {
+	return filepath.Join(g.binaryDir, name)
+}
+
+// BinaryDir returns the directory the postgres binaries are run from.
+func (g *GpgsqlRuntime) BinaryDir() string {
+	return g.binaryDir
+}
+
+// Version returns the postgres version of the binaries.
+func (g *GpgsqlRuntime) Version() string {
+	return g.version
+}
+
 func (g *GpgsqlRuntime) Host(host net.IP) *GpgsqlRuntime {
 	g.host = host
 	return g
@@ -119,11 +218,11 @@ func (g *GpgsqlRuntime) Logger(logger io.Writer) *GpgsqlRuntime {
 	return g
 }
 
+// DaemonArgs translates opt into postgres arguments, every option
+// maps to its own flag and is validated before anything is returned.
 func (g *GpgsqlRuntime) DaemonArgs(opt *PostgreSqlOptions) (args []string, e error) {
-	args = append(args, "-D", g.data)
-
-	if g.host != nil {
-		args = append(args, "-h", g.host.String())
+	if strings.TrimSpace(g.data) == "" {
+		return nil, errors.New("data directory is empty")
 	}
 
 	if g.port < 1 {
@@ -132,39 +231,67 @@ func (g *GpgsqlRuntime) DaemonArgs(opt *PostgreSqlOptions) (args []string, e err
 		}
 	}
 
-	args = append(args, "-p", fmt.Sprintf("%d", g.port))
+	if g.ephemeral {
+		opt = g.ephemeralOptions(opt)
+	}
+
+	if e := g.validateOptions(opt); e != nil {
+		return nil, fmt.Errorf("invalid postgres options: %s", e.Error())
+	}
+
+	args = append(args, "-D", g.data)
+
+	if g.host != nil {
+		args = append(args, "-h", g.host.String())
+	}
+
+	args = append(args, "-p", strconv.Itoa(int(g.port)))
+
+	if opt.Nbuffers > 0 {
+		args = append(args, "-B", strconv.FormatUint(opt.Nbuffers, 10))
+	}
+
+	if opt.DebugLevel > 0 {
+		args = append(args, "-d", strconv.FormatUint(uint64(opt.DebugLevel), 10))
+	}
 
-	switch {
-	case opt.Nbuffers > 0:
-		args = append(args, "-B", fmt.Sprintf("%d", opt.Nbuffers))
-		fallthrough
-	case opt.DebugLevel > 0:
-		args = append(args, "-d", fmt.Sprintf("%d", opt.DebugLevel))
-		fallthrough
-	case opt.DMY:
+	if opt.DMY {
 		args = append(args, "-e")
-		fallthrough
-	case opt.FsyncOff:
+	}
+
+	if opt.FsyncOff {
 		args = append(args, "-F")
-		fallthrough
-	case opt.EnableTcpConnections:
+	}
+
+	if opt.EnableTcpConnections {
 		args = append(args, "-i")
-		fallthrough
-	case strings.TrimSpace(opt.UnixSocket) != "":
+	}
+
+	if strings.TrimSpace(opt.UnixSocket) != "" {
 		args = append(args, "-k", opt.UnixSocket)
-		fallthrough
-	case opt.SSL:
+	}
+
+	if opt.SSL {
 		args = append(args, "-l")
-		fallthrough
-	case opt.MaxConnection > 0:
-		args = append(args, "-N", fmt.Sprintf("%d", opt.MaxConnection))
-		fallthrough
-	case opt.WorkMem > 0:
-		args = append(args, "-w", fmt.Sprintf("%d", opt.WorkMem))
 	}
 
-	for k, v := range opt.Parma {
-		args = append(args, "-c", fmt.Sprintf("%s=%s", k, v))
+	if opt.MaxConnection > 0 {
+		args = append(args, "-N", strconv.FormatUint(uint64(opt.MaxConnection), 10))
+	}
+
+	if opt.WorkMem > 0 {
+		args = append(args, "-S", strconv.FormatUint(opt.WorkMem, 10))
+	}
+
+	keys := make([]string, 0, len(opt.Parma))
+	for k := range opt.Parma {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		args = append(args, "-c", fmt.Sprintf("%s=%s", k, opt.Parma[k]))
 	}
 
 	args = append(args, opt.Args...)
@@ -172,92 +299,212 @@ func (g *GpgsqlRuntime) DaemonArgs(opt *PostgreSqlOptions) (args []string, e err
 	return args, nil
 }
 
-func (g *GpgsqlRuntime) Daemon(ctx context.Context, opts ...*PostgreSqlOptions) (kill func() error, e error) {
+// validateOptions checks opt against the postgres limits and reports
+// Parma keys that would override a typed option.
+func (g *GpgsqlRuntime) validateOptions(opt *PostgreSqlOptions) error {
+	if opt.Nbuffers > 0 && (opt.Nbuffers < minSharedBuffers || opt.Nbuffers > maxSharedBuffers) {
+		return fmt.Errorf("Nbuffers %d out of range [%d, %d]", opt.Nbuffers, minSharedBuffers, maxSharedBuffers)
+	}
+
+	if opt.DebugLevel > maxDebugLevel {
+		return fmt.Errorf("DebugLevel %d out of range [0, %d]", opt.DebugLevel, maxDebugLevel)
+	}
+
+	if opt.MaxConnection > maxConnections {
+		return fmt.Errorf("MaxConnection %d out of range [1, %d]", opt.MaxConnection, maxConnections)
+	}
+
+	if opt.WorkMem > 0 && (opt.WorkMem < minWorkMem || opt.WorkMem > maxWorkMem) {
+		return fmt.Errorf("WorkMem %d out of range [%d, %d]", opt.WorkMem, minWorkMem, maxWorkMem)
+	}
+
+	if dir := strings.TrimSpace(opt.UnixSocket); dir != "" {
+		for _, d := range strings.Split(dir, ",") {
+			socket := filepath.Join(strings.TrimSpace(d), fmt.Sprintf(".s.PGSQL.%d", g.port))
+			if len(socket) > maxUnixSocketPath {
+				return fmt.Errorf("unix socket path %q longer than %d bytes", socket, maxUnixSocketPath)
+			}
+		}
+	}
+
+	if opt.SSL {
+		for _, v := range [][2]string{{"ssl_cert_file", "server.crt"}, {"ssl_key_file", "server.key"}} {
+			param, file := v[0], v[1]
+
+			if v := strings.TrimSpace(opt.Parma[param]); v != "" {
+				file = v
+			}
+
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(g.data, file)
+			}
+
+			if _, e := os.Stat(file); e != nil {
+				return fmt.Errorf("SSL requires %s: %s", param, e.Error())
+			}
+		}
+	}
+
+	// run-time parameters that are already set through typed options
+	set := map[string]string{
+		"data_directory": "Data",
+		"port":           "Port",
+	}
+
+	for param, option := range map[string]struct {
+		name string
+		set  bool
+	}{
+		"listen_addresses":        {"Host/EnableTcpConnections", g.host != nil || opt.EnableTcpConnections},
+		"shared_buffers":          {"Nbuffers", opt.Nbuffers > 0},
+		"log_min_messages":        {"DebugLevel", opt.DebugLevel > 0},
+		"datestyle":               {"DMY", opt.DMY},
+		"fsync":                   {"FsyncOff", opt.FsyncOff},
+		"unix_socket_directories": {"UnixSocket", strings.TrimSpace(opt.UnixSocket) != ""},
+		"ssl":                     {"SSL", opt.SSL},
+		"max_connections":         {"MaxConnection", opt.MaxConnection > 0},
+		"work_mem":                {"WorkMem", opt.WorkMem > 0},
+	} {
+		if option.set {
+			set[param] = option.name
+		}
+	}
+
+	seen := map[string]string{}
+
+	for k := range opt.Parma {
+		name := strings.ToLower(strings.TrimSpace(k))
+
+		if !parameterNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid parameter name %q", k)
+		}
+
+		if other, ok := seen[name]; ok {
+			return fmt.Errorf("parameter %q set twice as %q and %q", name, other, k)
+		}
+
+		seen[name] = k
+
+		if option, ok := set[name]; ok {
+			return fmt.Errorf("parameter %q conflicts with %s", k, option)
+		}
+	}
+
+	return nil
+}
+
+// Daemon runs postgres as a child process. Cancelling ctx shuts the
+// server down in fast mode.
+func (g *GpgsqlRuntime) Daemon(ctx context.Context, opts ...*PostgreSqlOptions) (*Instance, error) {
 	if len(opts) < 1 || opts[0] == nil {
-		opts = append(opts, defaultPostgreSqlOptions)
+		opts = append(opts[:0], defaultPostgreSqlOptions)
 	}
 
 	opt := opts[0]
 
+	// validates the data directory before recovery touches it
 	args, e := g.DaemonArgs(opt)
 	if e != nil {
 		return nil, e
 	}
 
-	cmd := exec.CommandContext(ctx, postgresBinary, args...)
-
-	cmd.Stdout = g.logger
-	cmd.Stderr = g.logger
-	cmd.Dir = binaryRootPath
-
-	if e := cmd.Start(); e != nil {
+	if e := g.recoverStalePid(ctx); e != nil {
 		return nil, e
 	}
 
-	if opt.Wait > 0 {
-		time.Sleep(opt.Wait)
-	}
+	cmd := exec.Command(g.binary(release.PostgresBinary), args...)
+
+	watcher := newReadyWatcher()
+	cmd.Stdout = g.output(watcher)
+	cmd.Stderr = cmd.Stdout
+	cmd.Dir = g.binaryDir
+	cmd.SysProcAttr = g.daemonSysProcAttr()
 
-	if opt.Timeout < 1 {
-		opt.Timeout = defaultPostgreSqlOptions.Timeout
+	p, e := g.startProcess(cmd, func() {
+		watcher.Flush()
+		g.flushLogger()
+	})
+	if e != nil {
+		return nil, e
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), opt.Timeout)
-	defer cancel()
+	exited := make(chan error, 1)
+	go func() {
+		select {
+		case <-p.done:
+			exited <- p.err
+		case <-ctx.Done():
+			p.shutdown(context.Background(), ShutdownFast)
+		}
+	}()
 
-	if e := g.CheckConnection(ctx); e != nil {
+	if e := g.waitReady(ctx, opt, watcher, exited); e != nil {
+		p.shutdown(context.Background(), ShutdownImmediate)
 		return nil, e
 	}
 
-	return func() error {
-		return cmd.Process.Kill()
-	}, nil
+	return g.newProcessInstance(p), nil
 }
 
 func (g *GpgsqlRuntime) ListenAddr() string {
-	return fmt.Sprintf("%s:%d", g.host.String(), g.port)
+	return listenAddr(g.host, g.socket, g.port)
 }
 
-func (g *GpgsqlRuntime) Start(ctx context.Context, opts ...*PostgreSqlOptions) error {
+// Start runs postgres in the background through pg_ctl, the server
+// keeps running after this process exits.
+func (g *GpgsqlRuntime) Start(ctx context.Context, opts ...*PostgreSqlOptions) (*Instance, error) {
 	if len(opts) < 1 || opts[0] == nil {
-		opts = append(opts, defaultPostgreSqlOptions)
+		opts = append(opts[:0], defaultPostgreSqlOptions)
 	}
 
 	opt := opts[0]
 
+	// validates the data directory before recovery touches it
 	args, e := g.DaemonArgs(opt)
 	if e != nil {
-		return e
+		return nil, e
+	}
+
+	if e := g.recoverStalePid(ctx); e != nil {
+		return nil, e
 	}
 
 	if e := g.PgCli(ctx, CliStart, &PgCliOptions{
 		Wait:    true,
-		Timeout: int(opt.Wait.Seconds()),
+		Timeout: int(math.Ceil(readyTimeout(opt).Seconds())),
 		Options: args,
 	}); e != nil {
-		return e
+		return nil, e
 	}
 
-	if opt.Timeout < 1 {
-		opt.Timeout = defaultPostgreSqlOptions.Timeout
+	if e := g.waitReady(ctx, opt, nil, nil); e != nil {
+		return nil, fmt.Errorf("failed to check connection: %w", e)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), opt.Timeout)
-	defer cancel()
-
-	if e := g.CheckConnection(ctx); e != nil {
-		return fmt.Errorf("failed to check connection: %s", e.Error())
+	p, e := readPostmasterPid(g.data)
+	if e != nil {
+		return nil, fmt.Errorf("failed to read postmaster pid: %s", e.Error())
 	}
 
-	return nil
+	return g.newExternalInstance(p.PID), nil
 }
 
 func (g *GpgsqlRuntime) Stop(ctx context.Context) error {
-	if f, _ := os.Stat(filepath.Join(g.data, "postmaster.pid")); f != nil {
+	status, e := g.Status(ctx)
+	if e != nil {
+		return fmt.Errorf("failed to get status: %s", e.Error())
+	}
+
+	switch status.State {
+	case StateRunning, StateStarting, StateStopping:
 		if e := g.PgCli(ctx, CliStop); e != nil {
 			return fmt.Errorf("failed to stop postgres: %s", e.Error())
 		}
+	case StateStalePid:
+		if e := g.recoverStalePid(ctx); e != nil {
+			return e
+		}
 	}
 
-	return nil
+	return g.removeEphemeral()
 }
@@ -0,0 +1,215 @@
+package gpgsql
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRuntime returns a runtime on the embedded binaries, the test is
+// skipped where they cannot run a server.
+func testRuntime(t *testing.T) *GpgsqlRuntime {
+	t.Helper()
+
+	if testing.Short() {
+		t.Skip("runs postgres")
+	}
+
+	if runtime.GOOS != "windows" && os.Geteuid() == 0 {
+		t.Skip("postgres cannot run as root")
+	}
+
+	g, e := New()
+	if e != nil {
+		t.Skipf("no postgres binaries: %s", e.Error())
+	}
+
+	if _, e := binaryVersion(g.BinaryDir()); e != nil {
+		t.Skipf("postgres binaries do not run: %s", e.Error())
+	}
+
+	return g
+}
+
+func TestDaemonArgs(t *testing.T) {
+	data := t.TempDir()
+
+	for _, name := range []string{"server.crt", "server.key"} {
+		if e := os.WriteFile(filepath.Join(data, name), nil, 0600); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	base := []string{"-D", data, "-p", "5433"}
+
+	for _, c := range []struct {
+		name string
+		host net.IP
+		opt  *PostgreSqlOptions
+		want []string
+	}{
+		{"default", nil, &PostgreSqlOptions{}, base},
+		{"host", net.IP{127, 0, 0, 1}, &PostgreSqlOptions{}, []string{"-D", data, "-h", "127.0.0.1", "-p", "5433"}},
+		{"nbuffers", nil, &PostgreSqlOptions{Nbuffers: 128}, append(base, "-B", "128")},
+		{"debug level", nil, &PostgreSqlOptions{DebugLevel: 2}, append(base, "-d", "2")},
+		{"dmy", nil, &PostgreSqlOptions{DMY: true}, append(base, "-e")},
+		{"fsync off", nil, &PostgreSqlOptions{FsyncOff: true}, append(base, "-F")},
+		{"tcp", nil, &PostgreSqlOptions{EnableTcpConnections: true}, append(base, "-i")},
+		{"unix socket", nil, &PostgreSqlOptions{UnixSocket: "/tmp"}, append(base, "-k", "/tmp")},
+		{"ssl", nil, &PostgreSqlOptions{SSL: true}, append(base, "-l")},
+		{"max connection", nil, &PostgreSqlOptions{MaxConnection: 10}, append(base, "-N", "10")},
+		{"work mem", nil, &PostgreSqlOptions{WorkMem: 4096}, append(base, "-S", "4096")},
+		{"parma sorted", nil, &PostgreSqlOptions{Parma: map[string]string{"timezone": "UTC", "log_min_duration_statement": "0", "custom.x": "1"}},
+			append(base, "-c", "custom.x=1", "-c", "log_min_duration_statement=0", "-c", "timezone=UTC")},
+		{"args", nil, &PostgreSqlOptions{Args: []string{"-c", "jit=off"}}, append(base, "-c", "jit=off")},
+		{"all", nil, &PostgreSqlOptions{FsyncOff: true, WorkMem: 64, Parma: map[string]string{"jit": "off"}, Args: []string{"-t", "pa"}},
+			append(base, "-F", "-S", "64", "-c", "jit=off", "-t", "pa")},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			g := &GpgsqlRuntime{host: c.host, port: 5433, data: data}
+
+			args, e := g.DaemonArgs(c.opt)
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			if !reflect.DeepEqual(args, c.want) {
+				t.Fatalf("got %q, want %q", args, c.want)
+			}
+		})
+	}
+}
+
+func TestDaemonArgsInvalid(t *testing.T) {
+	data := t.TempDir()
+
+	for _, c := range []struct {
+		name string
+		host net.IP
+		opt  *PostgreSqlOptions
+		want string
+	}{
+		{"nbuffers low", nil, &PostgreSqlOptions{Nbuffers: 15}, "Nbuffers 15 out of range"},
+		{"nbuffers high", nil, &PostgreSqlOptions{Nbuffers: maxSharedBuffers + 1}, "Nbuffers 1073741824 out of range"},
+		{"debug level", nil, &PostgreSqlOptions{DebugLevel: 6}, "DebugLevel 6 out of range"},
+		{"max connection", nil, &PostgreSqlOptions{MaxConnection: maxConnections + 1}, "MaxConnection 262144 out of range"},
+		{"work mem low", nil, &PostgreSqlOptions{WorkMem: 63}, "WorkMem 63 out of range"},
+		{"work mem high", nil, &PostgreSqlOptions{WorkMem: maxWorkMem + 1}, "WorkMem 2147483648 out of range"},
+		{"unix socket", nil, &PostgreSqlOptions{UnixSocket: "/tmp," + strings.Repeat("x", 100)}, "longer than 103 bytes"},
+		{"ssl", nil, &PostgreSqlOptions{SSL: true}, "SSL requires ssl_cert_file"},
+		{"ssl key", nil, &PostgreSqlOptions{SSL: true, Parma: map[string]string{"ssl_cert_file": "/"}}, "SSL requires ssl_key_file"},
+		{"parameter name", nil, &PostgreSqlOptions{Parma: map[string]string{"work-mem": "1"}}, `invalid parameter name "work-mem"`},
+		{"parameter twice", nil, &PostgreSqlOptions{Parma: map[string]string{"jit": "on", "JIT": "off"}}, `parameter "jit" set twice`},
+		{"data_directory", nil, &PostgreSqlOptions{Parma: map[string]string{"data_directory": "/"}}, "conflicts with Data"},
+		{"port", nil, &PostgreSqlOptions{Parma: map[string]string{"Port": "1"}}, "conflicts with Port"},
+		{"listen_addresses host", net.IP{127, 0, 0, 1}, &PostgreSqlOptions{Parma: map[string]string{"listen_addresses": "*"}}, "conflicts with Host/EnableTcpConnections"},
+		{"listen_addresses tcp", nil, &PostgreSqlOptions{EnableTcpConnections: true, Parma: map[string]string{"listen_addresses": "*"}}, "conflicts with Host/EnableTcpConnections"},
+		{"shared_buffers", nil, &PostgreSqlOptions{Nbuffers: 16, Parma: map[string]string{"shared_buffers": "1"}}, "conflicts with Nbuffers"},
+		{"log_min_messages", nil, &PostgreSqlOptions{DebugLevel: 1, Parma: map[string]string{"log_min_messages": "debug1"}}, "conflicts with DebugLevel"},
+		{"datestyle", nil, &PostgreSqlOptions{DMY: true, Parma: map[string]string{"datestyle": "iso"}}, "conflicts with DMY"},
+		{"fsync", nil, &PostgreSqlOptions{FsyncOff: true, Parma: map[string]string{"fsync": "on"}}, "conflicts with FsyncOff"},
+		{"unix_socket_directories", nil, &PostgreSqlOptions{UnixSocket: "/tmp", Parma: map[string]string{"unix_socket_directories": "/"}}, "conflicts with UnixSocket"},
+		{"ssl param", nil, &PostgreSqlOptions{SSL: true, Parma: map[string]string{"ssl": "on", "ssl_cert_file": "/", "ssl_key_file": "/"}}, "conflicts with SSL"},
+		{"max_connections", nil, &PostgreSqlOptions{MaxConnection: 1, Parma: map[string]string{"max_connections": "2"}}, "conflicts with MaxConnection"},
+		{"work_mem", nil, &PostgreSqlOptions{WorkMem: 64, Parma: map[string]string{"work_mem": "1MB"}}, "conflicts with WorkMem"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			g := &GpgsqlRuntime{host: c.host, port: 5433, data: data}
+
+			args, e := g.DaemonArgs(c.opt)
+			if e == nil {
+				t.Fatalf("got %q, want error %q", args, c.want)
+			}
+
+			if !strings.Contains(e.Error(), c.want) {
+				t.Fatalf("got error %q, want %q", e.Error(), c.want)
+			}
+		})
+	}
+
+	// typed options that are not set leave their parameters free
+	g := &GpgsqlRuntime{port: 5433, data: data}
+
+	if _, e := g.DaemonArgs(&PostgreSqlOptions{Parma: map[string]string{"shared_buffers": "128MB", "fsync": "off", "work_mem": "1MB"}}); e != nil {
+		t.Fatal(e)
+	}
+
+	if _, e := (&GpgsqlRuntime{port: 5433}).DaemonArgs(&PostgreSqlOptions{}); e == nil {
+		t.Fatal("no error without data directory")
+	}
+}
+
+// testServer starts a server on an ephemeral data directory, it is
+// stopped and removed by t.Cleanup.
+func testServer(t *testing.T) *GpgsqlRuntime {
+	t.Helper()
+
+	testRuntime(t)
+
+	g, e := Ephemeral()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	t.Cleanup(func() { g.Cleanup() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if _, e := g.EnsureReady(ctx, &ReadySpec{
+		Initdb: &InitdbOptions{Encoding: "UTF8", NoLocale: true, AuthMethod: "trust"},
+		Daemon: true,
+	}); e != nil {
+		t.Fatal(e)
+	}
+
+	return g
+}
+
+func TestNewRuntimeCacheDirEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the postgres of the test archive is a shell script")
+	}
+
+	cache := t.TempDir()
+	t.Setenv(CacheDirEnv, cache)
+
+	g, e := NewRuntime(&RuntimeOptions{Provider: &ArchiveBinary{Path: testArchive}})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if filepath.Dir(g.BinaryDir()) != cache || g.cacheDir != cache {
+		t.Fatalf("binaries in %s and cache %s, want both in %s", g.BinaryDir(), g.cacheDir, cache)
+	}
+
+	if g.Version() != "14.5" {
+		t.Fatalf("version %q, want 14.5", g.Version())
+	}
+}
+
+func TestNewRuntimeVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the postgres of the test archive is a shell script")
+	}
+
+	cache := t.TempDir()
+
+	for _, version := range []string{"14", "14.5", "14.5.0"} {
+		if _, e := NewRuntime(&RuntimeOptions{CacheDir: cache, Provider: &ArchiveBinary{Path: testArchive}, Version: version}); e != nil {
+			t.Fatalf("Version %s: %s", version, e.Error())
+		}
+	}
+
+	for _, version := range []string{"15", "14.6", "1"} {
+		if _, e := NewRuntime(&RuntimeOptions{CacheDir: cache, Provider: &ArchiveBinary{Path: testArchive}, Version: version}); e == nil {
+			t.Fatalf("Version %s accepted for postgres 14.5", version)
+		}
+	}
+}
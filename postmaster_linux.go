@@ -0,0 +1,44 @@
+package gpgsql
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// isPostmaster reports whether the live process p.PID is still the
+// postmaster that wrote p, and not an unrelated process or another
+// postgres that reused the pid after a crash.
+func isPostmaster(p *PostmasterPid) bool {
+	comm, e := os.ReadFile("/proc/" + strconv.Itoa(p.PID) + "/comm")
+	if e == nil && strings.TrimSpace(string(comm)) != "postgres" {
+		return false
+	}
+
+	return shmExists(p.ShmKey)
+}
+
+// shmExists reports whether the shared memory segment of key ("key id")
+// still exists, an unknown segment counts as existing.
+func shmExists(key string) bool {
+	fields := strings.Fields(key)
+	if len(fields) < 2 || fields[1] == "0" {
+		return true
+	}
+
+	f, e := os.Open("/proc/sysvipc/shm")
+	if e != nil {
+		return true
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.Fields(scanner.Text()); len(line) > 1 && line[1] == fields[1] {
+			return true
+		}
+	}
+
+	return scanner.Err() != nil
+}
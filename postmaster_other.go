@@ -0,0 +1,9 @@
+//go:build !linux
+
+package gpgsql
+
+// isPostmaster reports whether the live process p.PID is still the
+// postmaster that wrote p, there is no cheap way to tell here.
+func isPostmaster(p *PostmasterPid) bool {
+	return true
+}
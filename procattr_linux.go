@@ -0,0 +1,16 @@
+package gpgsql
+
+import (
+	"syscall"
+)
+
+// daemonSysProcAttr lets the kernel take an ephemeral server down with
+// us when we die without running any cleanup, e.g. on a fatal panic.
+// The signal is tied to the starting thread, startProcess keeps it alive.
+func (g *GpgsqlRuntime) daemonSysProcAttr() *syscall.SysProcAttr {
+	if !g.ephemeral {
+		return nil
+	}
+
+	return &syscall.SysProcAttr{Pdeathsig: syscall.SIGQUIT}
+}
@@ -0,0 +1,65 @@
+package gpgsql
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// the thread that asked for the server may end long before the server,
+// e.g. a goroutine that exits while locked to its thread
+func TestDaemonSysProcAttrThreadExit(t *testing.T) {
+	g := &GpgsqlRuntime{ephemeral: true}
+
+	// keeps this goroutine off the threads of the starting goroutine
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var p *process
+
+	// the main thread never ends, the start must run on another one
+	for n := 0; n < 10 && p == nil; n++ {
+		started := make(chan *process, 1)
+
+		go func() {
+			// never unlocked, the thread ends with this goroutine
+			runtime.LockOSThread()
+
+			if syscall.Gettid() == os.Getpid() {
+				runtime.UnlockOSThread()
+				started <- nil
+				return
+			}
+
+			cmd := exec.Command("sleep", "60")
+			cmd.SysProcAttr = g.daemonSysProcAttr()
+
+			p, e := g.startProcess(cmd, nil)
+			if e != nil {
+				t.Error(e)
+			}
+
+			started <- p
+		}()
+
+		p = <-started
+	}
+
+	if p == nil {
+		t.Skip("no thread besides the main one")
+	}
+
+	defer func() {
+		p.cmd.Process.Kill()
+		<-p.done
+	}()
+
+	select {
+	case <-p.done:
+		t.Fatalf("server died with the starting thread: %v", p.err)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
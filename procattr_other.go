@@ -0,0 +1,12 @@
+//go:build !linux
+
+package gpgsql
+
+import (
+	"syscall"
+)
+
+// daemonSysProcAttr has nothing to add outside linux.
+func (g *GpgsqlRuntime) daemonSysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
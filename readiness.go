@@ -0,0 +1,232 @@
+package gpgsql
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// postmaster message once the server is ready
+	readyMessage = "database system is ready to accept connections"
+
+	// retry interval of connection checks
+	minCheckInterval = 50 * time.Millisecond
+	maxCheckInterval = time.Second
+
+	// output lines kept for error reports
+	readyWatcherLines = 20
+)
+
+var (
+	// fatal messages caused by our own connection checks while the server
+	// is still starting, they don't mean the startup has failed
+	startupNoise = []string{
+		"the database system is starting up",
+		"the database system is not yet accepting connections",
+	}
+)
+
+// lineWriter splits the written bytes into lines and passes every
+// complete line to fn.
+type lineWriter struct {
+	mu  sync.Mutex
+	buf []byte
+	fn  func(line string)
+}
+
+func newLineWriter(fn func(line string)) *lineWriter {
+	return &lineWriter{fn: fn}
+}
+
+func (w *lineWriter) Write(p []byte) (n int, e error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := strings.TrimRight(string(w.buf[:i]), "\r")
+		w.buf = w.buf[i+1:]
+
+		w.fn(line)
+	}
+
+	return len(p), nil
+}
+
+// Flush passes the remaining incomplete line to fn.
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) > 0 {
+		line := strings.TrimRight(string(w.buf), "\r")
+		w.buf = nil
+
+		w.fn(line)
+	}
+}
+
+// readyWatcher watches the postmaster output for the ready message
+// and for fatal startup errors.
+type readyWatcher struct {
+	*lineWriter
+
+	ready     chan struct{}
+	fatal     chan error
+	readyOnce sync.Once
+	fatalOnce sync.Once
+	isReady   bool
+	lines     []string // last output lines
+}
+
+func newReadyWatcher() *readyWatcher {
+	w := &readyWatcher{
+		ready: make(chan struct{}),
+		fatal: make(chan error, 1),
+	}
+
+	w.lineWriter = newLineWriter(w.line)
+	return w
+}
+
+func (w *readyWatcher) line(line string) {
+	if w.lines = append(w.lines, line); len(w.lines) > readyWatcherLines {
+		w.lines = w.lines[1:]
+	}
+
+	if strings.Contains(line, readyMessage) {
+		w.isReady = true
+		w.readyOnce.Do(func() { close(w.ready) })
+		return
+	}
+
+	if w.isReady || !(strings.Contains(line, "FATAL:") || strings.Contains(line, "PANIC:")) {
+		return
+	}
+
+	for _, noise := range startupNoise {
+		if strings.Contains(line, noise) {
+			return
+		}
+	}
+
+	w.fatalOnce.Do(func() { w.fatal <- ClassifyOutput(strings.Join(w.lines, "\n")) })
+}
+
+// outputError classifies the last output lines, nil without output.
+func (w *readyWatcher) outputError() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.lines) < 1 {
+		return nil
+	}
+
+	return ClassifyOutput(strings.Join(w.lines, "\n"))
+}
+
+// output returns the writer for the child process output,
+// copying everything to the runtime logger.
+func (g *GpgsqlRuntime) output(w io.Writer) io.Writer {
+	if g.logger == nil {
+		return w
+	}
+
+	return io.MultiWriter(g.logger, w)
+}
+
+// waitReady retries the connection check with backoff until the server
+// answers, the watcher reports a fatal error, the process exits or
+// opt.Timeout has passed. watcher and exited may be nil.
+func (g *GpgsqlRuntime) waitReady(ctx context.Context, opt *PostgreSqlOptions, watcher *readyWatcher, exited <-chan error) error {
+	var (
+		ready <-chan struct{}
+		fatal <-chan error
+	)
+
+	if watcher != nil {
+		ready, fatal = watcher.ready, watcher.fatal
+	}
+
+	timeout := readyTimeout(opt)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	interval := minCheckInterval
+	lastErr := errors.New("no connection attempt")
+
+	for {
+		e := g.CheckConnection(ctx)
+		if e == nil {
+			return nil
+		}
+
+		// waiting won't fix wrong credentials
+		if errors.Is(e, ErrAuthentication) {
+			return e
+		}
+
+		lastErr = e
+
+		timer := time.NewTimer(interval)
+
+		select {
+		case <-ready:
+			// check again right away, but only once
+			ready = nil
+		case e := <-fatal:
+			timer.Stop()
+			return fmt.Errorf("postgres failed to start: %w", e)
+		case e := <-exited:
+			timer.Stop()
+			select {
+			case fe := <-fatal:
+				e = fe
+			default:
+				if watcher != nil {
+					if oe := watcher.outputError(); oe != nil {
+						e = oe
+					}
+				}
+			}
+
+			if e == nil {
+				e = errors.New("exit status 0")
+			}
+
+			return fmt.Errorf("postgres exited before ready: %w", e)
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("postgres not ready after %s: %w", timeout, lastErr)
+		case <-timer.C:
+		}
+
+		timer.Stop()
+
+		if interval *= 2; interval > maxCheckInterval {
+			interval = maxCheckInterval
+		}
+	}
+}
+
+// readyTimeout is how long to wait for the server, opt may be nil.
+func readyTimeout(opt *PostgreSqlOptions) time.Duration {
+	if opt == nil || opt.Timeout < 1 {
+		return defaultPostgreSqlOptions.Timeout
+	}
+
+	return opt.Timeout
+}
@@ -0,0 +1,107 @@
+package gpgsql
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitReadyTimeout(t *testing.T) {
+	// a port nothing listens on
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	g := &GpgsqlRuntime{host: net.IP{127, 0, 0, 1}, port: port, username: "postgres"}
+
+	start := time.Now()
+
+	e = g.waitReady(context.Background(), &PostgreSqlOptions{Timeout: 300 * time.Millisecond}, nil, nil)
+	if e == nil || !strings.Contains(e.Error(), "not ready after 300ms") {
+		t.Fatalf("got %v, want not ready after 300ms", e)
+	}
+
+	// retried until Timeout, and not longer
+	if d := time.Since(start); d < 300*time.Millisecond || d > 3*time.Second {
+		t.Fatalf("gave up after %s", d)
+	}
+}
+
+func TestReadyWatcher(t *testing.T) {
+	const (
+		starting = "2022-10-10 10:00:00.000 UTC [1] LOG:  starting PostgreSQL 14.5"
+		ready    = "2022-10-10 10:00:01.000 UTC [1] LOG:  database system is ready to accept connections"
+	)
+
+	for _, c := range []struct {
+		name  string
+		lines []string
+		tail  string // written without a line end
+		ready bool
+		err   error // nil for no fatal error, errFatal for an unclassified one
+	}{
+		{"ready", []string{starting, ready}, "", true, nil},
+		{"nothing yet", []string{starting}, "", false, nil},
+		{"port in use", []string{
+			starting,
+			`LOG:  could not bind IPv4 address "127.0.0.1": Address already in use`,
+			"FATAL:  could not create any TCP/IP sockets",
+		}, "", false, ErrPortInUse},
+		{"panic", []string{starting, "PANIC:  could not locate a valid checkpoint record"}, "", false, errFatal},
+		{"starting up", []string{starting, "FATAL:  the database system is starting up", ready}, "", true, nil},
+		{"not yet accepting", []string{"FATAL:  the database system is not yet accepting connections"}, "", false, nil},
+		{"fatal after ready", []string{starting, ready, `FATAL:  role "nobody" does not exist`}, "", true, nil},
+		{"partial line", []string{starting}, "FATAL:  could not", false, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			w := newReadyWatcher()
+
+			for _, line := range c.lines {
+				w.Write([]byte(line + "\n"))
+			}
+
+			w.Write([]byte(c.tail))
+
+			select {
+			case <-w.ready:
+				if !c.ready {
+					t.Fatal("ready without the ready message")
+				}
+			default:
+				if c.ready {
+					t.Fatal("not ready after the ready message")
+				}
+			}
+
+			select {
+			case e := <-w.fatal:
+				if c.err == nil {
+					t.Fatalf("startup failed: %s", e.Error())
+				}
+
+				var oe *OutputError
+				if !errors.As(e, &oe) {
+					t.Fatalf("got %T, want *OutputError", e)
+				}
+
+				if c.err != errFatal && !errors.Is(e, c.err) {
+					t.Fatalf("got %v, want %v", e, c.err)
+				}
+			default:
+				if c.err != nil {
+					t.Fatal("startup did not fail")
+				}
+			}
+		})
+	}
+}
+
+// stands for an unclassified fatal error in TestReadyWatcher
+var errFatal = errors.New("fatal")
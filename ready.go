@@ -0,0 +1,138 @@
+package gpgsql
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// poll interval while another process starts or stops the server
+	statusPollInterval = 100 * time.Millisecond
+)
+
+type ReadySpec struct {
+	Initdb   *InitdbOptions     // used when the data directory is empty
+	Server   *PostgreSqlOptions // used when the server is not running yet
+	Daemon   bool               // run postgres as our child process instead of through pg_ctl
+	Template bool               // copy a cached cluster instead of running initdb every time
+}
+
+// EnsureReady initializes the data directory when it is empty, attaches
+// to a server already running on it or starts one, and waits until it
+// accepts connections. Junk files like .DS_Store that initdb refuses
+// are removed first, other entries like lost+found or .gitkeep are
+// never removed and fail. It is safe to call repeatedly and concurrently,
+// later calls return the same instance while it is running. The server
+// outlives ctx, stop it through the returned Instance.
+func (g *GpgsqlRuntime) EnsureReady(ctx context.Context, spec *ReadySpec) (*Instance, error) {
+	if spec == nil {
+		spec = &ReadySpec{}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if i := g.instance; i != nil {
+		select {
+		case <-i.Done():
+		default:
+			if e := g.CheckConnection(ctx); e != nil {
+				return nil, fmt.Errorf("failed to check connection: %w", e)
+			}
+
+			return i, nil
+		}
+	}
+
+	if e := g.ensureData(ctx, spec.Initdb, spec.Template); e != nil {
+		return nil, e
+	}
+
+	status, e := g.waitStatus(ctx, spec.Server)
+	if e != nil {
+		return nil, e
+	}
+
+	var i *Instance
+
+	switch {
+	case status.State == StateRunning:
+		i, e = g.Attach(ctx)
+	case spec.Daemon:
+		i, e = g.Daemon(context.WithoutCancel(ctx), spec.Server)
+	default:
+		i, e = g.Start(ctx, spec.Server)
+	}
+
+	if e != nil {
+		return nil, e
+	}
+
+	g.instance = i
+	return i, nil
+}
+
+// ensureData initializes an empty data directory and refuses
+// directories it can't safely use.
+func (g *GpgsqlRuntime) ensureData(ctx context.Context, opt *InitdbOptions, template bool) error {
+	info, e := g.InspectData()
+	if e != nil {
+		return fmt.Errorf("failed to inspect data directory: %s", e.Error())
+	}
+
+	switch info.State {
+	case DataMissing, DataEmpty:
+		if e := os.MkdirAll(g.data, PostgresqlDataPerm); e != nil {
+			return e
+		}
+
+		if e := g.removeJunkEntries(); e != nil {
+			return e
+		}
+
+		initdb := g.Initdb
+		if template {
+			initdb = g.InitdbFromTemplate
+		}
+
+		if e := initdb(ctx, opt); e != nil {
+			return fmt.Errorf("failed to initdb: %w", e)
+		}
+	case DataPartial:
+		return fmt.Errorf("data directory is half initialized, missing %s", strings.Join(info.Missing, ", "))
+	case DataVersionMismatch:
+		return fmt.Errorf("%w: cluster version %s, server version %s",
+			ErrIncompatibleVersion, info.Version, majorVersion(g.version))
+	case DataUnknown:
+		return fmt.Errorf("data directory %s is not a cluster", g.data)
+	}
+
+	return nil
+}
+
+// waitStatus waits while another process is starting or stopping the
+// server on the data directory, at most opt.Timeout.
+func (g *GpgsqlRuntime) waitStatus(ctx context.Context, opt *PostgreSqlOptions) (*ServerStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout(opt))
+	defer cancel()
+
+	for {
+		status, e := g.Status(ctx)
+		if e != nil {
+			return nil, fmt.Errorf("failed to get status: %s", e.Error())
+		}
+
+		if status.State != StateStarting && status.State != StateStopping {
+			return status, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: still %s", ErrDataDirLocked, status.State)
+		case <-time.After(statusPollInterval):
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package gpgsql
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRemoveJunkEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string // entries ending in / are directories
+		err     string
+		left    []string
+	}{
+		{"junk", []string{".DS_Store", "Thumbs.db", "desktop.ini"}, "", nil},
+		{"lost+found", []string{".DS_Store", "lost+found/x"}, "use a subdirectory", []string{".DS_Store", "lost+found"}},
+		{"gitkeep", []string{".gitkeep"}, ".gitkeep", []string{".gitkeep"}},
+		{"user file", []string{"keep"}, "keep", []string{"keep"}},
+		{"junk directory", []string{".DS_Store/x"}, "not a regular file", []string{".DS_Store"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := t.TempDir()
+
+			for _, name := range tt.entries {
+				path := filepath.Join(data, name)
+
+				if e := os.MkdirAll(filepath.Dir(path), 0700); e != nil {
+					t.Fatal(e)
+				}
+
+				if e := os.WriteFile(path, nil, 0600); e != nil {
+					t.Fatal(e)
+				}
+			}
+
+			e := (&GpgsqlRuntime{data: data}).removeJunkEntries()
+
+			if tt.err == "" && e != nil {
+				t.Fatal(e)
+			}
+
+			if tt.err != "" && (e == nil || !strings.Contains(e.Error(), tt.err)) {
+				t.Fatalf("got %v, want an error naming %s", e, tt.err)
+			}
+
+			for _, name := range tt.left {
+				if _, e := os.Lstat(filepath.Join(data, name)); e != nil {
+					t.Fatalf("%s removed: %s", name, e.Error())
+				}
+			}
+		})
+	}
+
+	if e := (&GpgsqlRuntime{data: filepath.Join(t.TempDir(), "missing")}).removeJunkEntries(); e != nil {
+		t.Fatalf("missing directory: %s", e.Error())
+	}
+}
+
+// initdb refuses a directory holding dot files, EnsureReady must
+// remove the junk files among them
+func TestEnsureReadyIgnoredEntries(t *testing.T) {
+	g := testRuntime(t)
+
+	if e := g.Data(t.TempDir()); e != nil {
+		t.Fatal(e)
+	}
+
+	if e := os.WriteFile(filepath.Join(g.data, ".DS_Store"), []byte("finder"), 0600); e != nil {
+		t.Fatal(e)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	i, e := g.EnsureReady(ctx, &ReadySpec{
+		Initdb: &InitdbOptions{Encoding: "UTF8", NoLocale: true, AuthMethod: "trust"},
+		Daemon: true,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer i.Stop(context.Background(), ShutdownFast)
+
+	if e := g.CheckConnection(ctx); e != nil {
+		t.Fatal(e)
+	}
+}
+
+// lockedBuffer collects the output of concurrent writers.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func testReadySpec() *ReadySpec {
+	return &ReadySpec{
+		Initdb: &InitdbOptions{Encoding: "UTF8", NoLocale: true, AuthMethod: "trust"},
+		Daemon: true,
+	}
+}
+
+func TestEnsureReadyAgain(t *testing.T) {
+	g := testServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	first, e := g.EnsureReady(ctx, testReadySpec())
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	second, e := g.EnsureReady(ctx, testReadySpec())
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if first != second {
+		t.Fatalf("second call returned another instance, pid %d and %d", first.PID(), second.PID())
+	}
+}
+
+// concurrent calls share one initdb and one postmaster
+func TestEnsureReadyConcurrent(t *testing.T) {
+	g := testRuntime(t)
+	logs := &lockedBuffer{}
+	g.Logger(logs)
+
+	if e := g.Data(filepath.Join(t.TempDir(), "data")); e != nil {
+		t.Fatal(e)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	instances := make([]*Instance, 8)
+	errs := make([]error, len(instances))
+
+	var wg sync.WaitGroup
+
+	for n := range instances {
+		wg.Add(1)
+
+		go func(n int) {
+			defer wg.Done()
+			instances[n], errs[n] = g.EnsureReady(ctx, testReadySpec())
+		}(n)
+	}
+
+	wg.Wait()
+
+	for n, e := range errs {
+		if e != nil {
+			t.Fatalf("call %d: %s", n, e.Error())
+		}
+	}
+
+	defer instances[0].Stop(context.Background(), ShutdownFast)
+
+	for n, i := range instances {
+		if i != instances[0] {
+			t.Fatalf("call %d returned pid %d, want %d", n, i.PID(), instances[0].PID())
+		}
+	}
+
+	out := logs.String()
+
+	if n := strings.Count(out, "The files belonging to this database system"); n != 1 {
+		t.Fatalf("initdb ran %d times, want once:\n%s", n, out)
+	}
+
+	if n := strings.Count(out, readyMessage); n != 1 {
+		t.Fatalf("postmaster started %d times, want once:\n%s", n, out)
+	}
+}
+
+// a postmaster.pid left behind by a dead server does not stop the next start
+func TestEnsureReadyStalePid(t *testing.T) {
+	g := testServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	i, e := g.EnsureReady(ctx, testReadySpec())
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if e := i.Stop(ctx, ShutdownFast); e != nil {
+		t.Fatal(e)
+	}
+
+	writePostmasterPid(t, g.data, deadPid(t), "ready")
+
+	i, e = g.EnsureReady(ctx, testReadySpec())
+	if e != nil {
+		t.Fatalf("stale postmaster.pid: %s", e.Error())
+	}
+
+	if e := g.CheckConnection(ctx); e != nil {
+		t.Fatal(e)
+	}
+
+	if i.PID() == 0 {
+		t.Fatal("no pid for the restarted server")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build gpgsql_noembed && !windows
+
+package release
+
+// Built without the embedded archive, binaries come from another
+// gpgsql.BinaryProvider.
+const (
+	Embedded = false
+
+	Target  = ""
+	Arch    = ""
+	Version = ""
+	Sha256  = ""
+
+	InitdbBinary   = "bin/initdb"
+	PgCliBinary    = "bin/pg_ctl"
+	PostgresBinary = "bin/postgres"
+)
+
+var (
+	Archive []byte
+)
@@ -0,0 +1,22 @@
+//go:build gpgsql_noembed && windows
+
+package release
+
+// Built without the embedded archive, binaries come from another
+// gpgsql.BinaryProvider.
+const (
+	Embedded = false
+
+	Target  = ""
+	Arch    = ""
+	Version = ""
+	Sha256  = ""
+
+	InitdbBinary   = "bin/initdb.exe"
+	PgCliBinary    = "bin/pg_ctl.exe"
+	PostgresBinary = "bin/postgres.exe"
+)
+
+var (
+	Archive []byte
+)
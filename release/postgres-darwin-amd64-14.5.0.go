@@ -1,4 +1,4 @@
-//go:build darwin && amd64
+//go:build darwin && amd64 && !gpgsql_noembed
 
 // This file generated by cmd/gen/main.go - DO NOT EDIT
 
@@ -9,6 +9,8 @@ import (
 )
 
 const (
+	Embedded = true
+
 	Target  = "darwin"
 	Arch    = "amd64"
 	Version = "14.5.0"
@@ -23,3 +25,13 @@ var (
 	//go:embed postgres-darwin-amd64-14.5.0.tar.xz
 	Archive []byte
 )
+
+func init() {
+	Register(&Release{
+		Target:  Target,
+		Arch:    Arch,
+		Version: Version,
+		Sha256:  Sha256,
+		Archive: Archive,
+	})
+}
@@ -1,4 +1,4 @@
-//go:build darwin && arm64
+//go:build darwin && arm64 && !gpgsql_noembed
 
 // This file generated by cmd/gen/main.go - DO NOT EDIT
 
@@ -9,6 +9,8 @@ import (
 )
 
 const (
+	Embedded = true
+
 	Target  = "darwin"
 	Arch    = "arm64"
 	Version = "14.5.0"
@@ -23,3 +25,13 @@ var (
 	//go:embed postgres-darwin-arm64-14.5.0.tar.xz
 	Archive []byte
 )
+
+func init() {
+	Register(&Release{
+		Target:  Target,
+		Arch:    Arch,
+		Version: Version,
+		Sha256:  Sha256,
+		Archive: Archive,
+	})
+}
@@ -0,0 +1,72 @@
+package release
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Release is one embedded postgres build. The default one is also
+// exposed through the constants, further versions are embedded with
+// the gpgsql_pg<major> build tags.
+type Release struct {
+	Target  string
+	Arch    string
+	Version string
+	Sha256  string
+	Archive []byte
+}
+
+var (
+	// registered by the init of the generated files
+	releases []*Release
+)
+
+// Register adds an embedded release, the generated files call it.
+func Register(r *Release) {
+	releases = append(releases, r)
+
+	sort.SliceStable(releases, func(i, j int) bool {
+		return compareVersion(releases[i].Version, releases[j].Version) > 0
+	})
+}
+
+// Releases returns the embedded releases, newest first.
+func Releases() []*Release {
+	return append([]*Release(nil), releases...)
+}
+
+// Lookup returns the newest embedded release matching version, which
+// is a full version like 14.5.0 or a prefix of one like 14, or nil.
+func Lookup(version string) *Release {
+	for _, r := range releases {
+		if r.Version == version || strings.HasPrefix(r.Version, version+".") {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// compareVersion compares dotted versions numerically.
+func compareVersion(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+
+		if x != y {
+			return x - y
+		}
+	}
+
+	return 0
+}
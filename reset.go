@@ -0,0 +1,225 @@
+package gpgsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// userRelations keeps relations c in namespace n of the kinds in $1
+	// that belong to the user, in the schemas of $2 when it is not empty.
+	userRelations = `c.relkind = ANY($1)
+		AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+		AND n.nspname NOT LIKE 'pg\_toast%' AND n.nspname NOT LIKE 'pg\_temp%'
+		AND NOT EXISTS (SELECT 1 FROM pg_depend e WHERE e.objid = c.oid AND e.deptype = 'e')
+		AND (coalesce(cardinality($2::text[]), 0) = 0 OR n.nspname = ANY($2))`
+)
+
+var (
+	defaultResetOptions = &ResetOptions{}
+)
+
+type ResetOptions struct {
+	Schemas        []string                                    // schemas to reset, every user schema by default
+	Exclude        []string                                    // tables left alone, "table" in any schema or "schema.table"
+	ResetSequences bool                                        // also restart sequences no truncated column owns
+	Fixtures       []string                                    // sql run after the reset, e.g. seed data
+	Seed           func(ctx context.Context, tx *sql.Tx) error // run after the fixtures
+}
+
+// Reset empties every user table of dbname with a single TRUNCATE ...
+// RESTART IDENTITY and reloads the fixtures, all in one transaction.
+// The schema is kept. Tables of extensions are never touched. Reset
+// fails without touching anything when a table it leaves alone, excluded
+// or outside Schemas, references a truncated one, TRUNCATE could only
+// empty both.
+func (g *GpgsqlRuntime) Reset(ctx context.Context, dbname string, opts ...*ResetOptions) error {
+	if len(opts) < 1 || opts[0] == nil {
+		opts = append(opts[:0], defaultResetOptions)
+	}
+
+	opt := opts[0]
+
+	db, e := g.DB(dbname)
+	if e != nil {
+		return e
+	}
+	defer db.Close()
+
+	tx, e := db.BeginTx(ctx, nil)
+	if e != nil {
+		return fmt.Errorf("failed to begin transaction: %s", e.Error())
+	}
+	defer tx.Rollback()
+
+	tables, e := resetTables(ctx, tx, opt)
+	if e != nil {
+		return e
+	}
+
+	if len(tables) > 0 {
+		if e := resetReferences(ctx, tx, tables); e != nil {
+			return e
+		}
+
+		if _, e := tx.ExecContext(ctx, "TRUNCATE TABLE "+strings.Join(tables, ", ")+" RESTART IDENTITY"); e != nil {
+			return fmt.Errorf("failed to truncate tables: %s", e.Error())
+		}
+	}
+
+	if opt.ResetSequences {
+		if e := resetSequences(ctx, tx, opt); e != nil {
+			return e
+		}
+	}
+
+	for i, fixture := range opt.Fixtures {
+		if _, e := tx.ExecContext(ctx, fixture); e != nil {
+			return fmt.Errorf("failed to load fixture %d: %s", i, e.Error())
+		}
+	}
+
+	if opt.Seed != nil {
+		if e := opt.Seed(ctx, tx); e != nil {
+			return fmt.Errorf("failed to seed: %w", e)
+		}
+	}
+
+	if e := tx.Commit(); e != nil {
+		return fmt.Errorf("failed to commit reset: %s", e.Error())
+	}
+
+	return nil
+}
+
+// resetTables returns the quoted names of the tables to truncate.
+func resetTables(ctx context.Context, tx *sql.Tx, opt *ResetOptions) ([]string, error) {
+	rows, e := tx.QueryContext(ctx, `SELECT n.nspname, c.relname FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE `+userRelations+` ORDER BY 1, 2`, pq.Array([]string{"r", "p"}), pq.Array(opt.Schemas))
+	if e != nil {
+		return nil, fmt.Errorf("failed to list tables: %s", e.Error())
+	}
+	defer rows.Close()
+
+	tables := []string{}
+
+	for rows.Next() {
+		var schema, name string
+		if e := rows.Scan(&schema, &name); e != nil {
+			return nil, fmt.Errorf("failed to list tables: %s", e.Error())
+		}
+
+		if !resetExcluded(opt.Exclude, schema, name) {
+			tables = append(tables, pq.QuoteIdentifier(schema)+"."+pq.QuoteIdentifier(name))
+		}
+	}
+
+	if e := rows.Err(); e != nil {
+		return nil, fmt.Errorf("failed to list tables: %s", e.Error())
+	}
+
+	return tables, nil
+}
+
+// resetReferences fails naming the foreign keys of tables left alone
+// that reference one of tables, postgres refuses to truncate them.
+func resetReferences(ctx context.Context, tx *sql.Tx, tables []string) error {
+	rows, e := tx.QueryContext(ctx, `SELECT DISTINCT rn.nspname, r.relname, c.conname, fn.nspname, f.relname
+		FROM pg_constraint c
+		JOIN pg_class r ON r.oid = c.conrelid
+		JOIN pg_namespace rn ON rn.oid = r.relnamespace
+		JOIN pg_class f ON f.oid = c.confrelid
+		JOIN pg_namespace fn ON fn.oid = f.relnamespace
+		WHERE c.contype = 'f' AND c.confrelid = ANY($1::regclass[]) AND c.conrelid <> ALL($1::regclass[])
+		ORDER BY 1, 2, 3`, pq.Array(tables))
+	if e != nil {
+		return fmt.Errorf("failed to list foreign keys: %s", e.Error())
+	}
+	defer rows.Close()
+
+	references := []string{}
+
+	for rows.Next() {
+		var schema, name, constraint, refSchema, refName string
+		if e := rows.Scan(&schema, &name, &constraint, &refSchema, &refName); e != nil {
+			return fmt.Errorf("failed to list foreign keys: %s", e.Error())
+		}
+
+		references = append(references, fmt.Sprintf("%s.%s (%s) references %s.%s",
+			schema, name, constraint, refSchema, refName))
+	}
+
+	if e := rows.Err(); e != nil {
+		return fmt.Errorf("failed to list foreign keys: %s", e.Error())
+	}
+
+	if len(references) > 0 {
+		return fmt.Errorf("tables left alone reference truncated tables, exclude those too or drop the foreign keys: %s",
+			strings.Join(references, ", "))
+	}
+
+	return nil
+}
+
+// resetSequences restarts the sequences not owned by an excluded table,
+// the ones of truncated tables are restarted by TRUNCATE already.
+func resetSequences(ctx context.Context, tx *sql.Tx, opt *ResetOptions) error {
+	rows, e := tx.QueryContext(ctx, `SELECT n.nspname, c.relname, tn.nspname, t.relname FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_depend d ON d.objid = c.oid AND d.classid = 'pg_class'::regclass
+			AND d.refclassid = 'pg_class'::regclass AND d.deptype IN ('a', 'i')
+		LEFT JOIN pg_class t ON t.oid = d.refobjid
+		LEFT JOIN pg_namespace tn ON tn.oid = t.relnamespace
+		WHERE `+userRelations,
+		pq.Array([]string{"S"}), pq.Array(opt.Schemas))
+	if e != nil {
+		return fmt.Errorf("failed to list sequences: %s", e.Error())
+	}
+
+	sequences := []string{}
+
+	for rows.Next() {
+		var schema, name string
+		var ownerSchema, owner sql.NullString
+
+		if e := rows.Scan(&schema, &name, &ownerSchema, &owner); e != nil {
+			rows.Close()
+			return fmt.Errorf("failed to list sequences: %s", e.Error())
+		}
+
+		if owner.Valid && resetExcluded(opt.Exclude, ownerSchema.String, owner.String) {
+			continue
+		}
+
+		sequences = append(sequences, pq.QuoteIdentifier(schema)+"."+pq.QuoteIdentifier(name))
+	}
+
+	rows.Close()
+
+	if e := rows.Err(); e != nil {
+		return fmt.Errorf("failed to list sequences: %s", e.Error())
+	}
+
+	for _, sequence := range sequences {
+		if _, e := tx.ExecContext(ctx, "ALTER SEQUENCE "+sequence+" RESTART"); e != nil {
+			return fmt.Errorf("failed to restart sequence %s: %s", sequence, e.Error())
+		}
+	}
+
+	return nil
+}
+
+func resetExcluded(exclude []string, schema, name string) bool {
+	for _, x := range exclude {
+		if x == name || x == schema+"."+name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,188 @@
+package gpgsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResetExcluded(t *testing.T) {
+	exclude := []string{"keep", "other.log"}
+
+	for _, c := range []struct {
+		schema, name string
+		want         bool
+	}{
+		{"public", "keep", true},
+		{"other", "keep", true},
+		{"other", "log", true},
+		{"public", "log", false},
+		{"public", "keeper", false},
+	} {
+		if got := resetExcluded(exclude, c.schema, c.name); got != c.want {
+			t.Errorf("resetExcluded(%s.%s) = %t, want %t", c.schema, c.name, got, c.want)
+		}
+	}
+}
+
+// queryInt runs a query returning a single integer.
+func queryInt(t *testing.T, db *sql.DB, query string) int {
+	t.Helper()
+
+	var n int
+	if e := db.QueryRow(query).Scan(&n); e != nil {
+		t.Fatalf("%s: %s", query, e.Error())
+	}
+
+	return n
+}
+
+func TestReset(t *testing.T) {
+	g := testServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	db, e := g.DB(g.username)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer db.Close()
+
+	if _, e := db.ExecContext(ctx, `
+		CREATE TABLE parent (id serial PRIMARY KEY, name text);
+		CREATE TABLE child (id serial PRIMARY KEY, parent_id int REFERENCES parent (id));
+		CREATE TABLE keep (id serial PRIMARY KEY);
+		CREATE TABLE log (id int);
+		CREATE SCHEMA other;
+		CREATE TABLE other.log (id int);
+		CREATE SEQUENCE counter;
+
+		INSERT INTO parent (name) VALUES ('a'), ('b');
+		INSERT INTO child (parent_id) VALUES (2);
+		INSERT INTO keep DEFAULT VALUES;
+		INSERT INTO keep DEFAULT VALUES;
+		INSERT INTO log VALUES (1);
+		INSERT INTO other.log VALUES (1);
+		SELECT nextval('counter'), nextval('counter')`); e != nil {
+		t.Fatal(e)
+	}
+
+	opt := &ResetOptions{
+		Exclude:        []string{"keep", "other.log"},
+		ResetSequences: true,
+		Fixtures:       []string{"INSERT INTO parent (name) VALUES ('fixture')"},
+		Seed: func(ctx context.Context, tx *sql.Tx) error {
+			_, e := tx.ExecContext(ctx, "INSERT INTO child (parent_id) VALUES (1)")
+			return e
+		},
+	}
+
+	if e := g.Reset(ctx, g.username, opt); e != nil {
+		t.Fatal(e)
+	}
+
+	for query, want := range map[string]int{
+		// truncated, identities restarted, fixture and seed reloaded
+		"SELECT count(*) FROM parent":                  1,
+		"SELECT id FROM parent WHERE name = 'fixture'": 1,
+		"SELECT count(*) FROM child":                   1,
+		"SELECT id FROM child":                         1,
+		"SELECT count(*) FROM log":                     0,
+		// excluded by name in any schema and by schema.table
+		"SELECT count(*) FROM keep":      2,
+		"SELECT count(*) FROM other.log": 1,
+		// sequences of excluded tables go on, others restart
+		"SELECT nextval('keep_id_seq')": 3,
+		"SELECT nextval('counter')":     1,
+	} {
+		if n := queryInt(t, db, query); n != want {
+			t.Errorf("%s = %d, want %d", query, n, want)
+		}
+	}
+
+	// a failing seed leaves everything as it was
+	broken := errors.New("seed failed")
+
+	if e := g.Reset(ctx, g.username, &ResetOptions{
+		Seed: func(ctx context.Context, tx *sql.Tx) error { return broken },
+	}); !errors.Is(e, broken) {
+		t.Fatalf("got %v, want %v", e, broken)
+	}
+
+	if n := queryInt(t, db, "SELECT count(*) FROM keep"); n != 2 {
+		t.Fatalf("%d rows in keep after a failed reset, want 2", n)
+	}
+
+	// without options only the tables are emptied
+	if e := g.Reset(ctx, g.username); e != nil {
+		t.Fatal(e)
+	}
+
+	for _, table := range []string{"parent", "child", "keep", "log", "other.log"} {
+		if n := queryInt(t, db, "SELECT count(*) FROM "+table); n != 0 {
+			t.Errorf("%d rows in %s, want 0", n, table)
+		}
+	}
+
+	if n := queryInt(t, db, "SELECT nextval('counter')"); n != 2 {
+		t.Fatalf("counter restarted without ResetSequences, got %d", n)
+	}
+}
+
+// TRUNCATE can't empty a referenced table without emptying the excluded
+// tables that reference it, Reset refuses instead
+func TestResetExcludedReference(t *testing.T) {
+	g := testServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	db, e := g.DB(g.username)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer db.Close()
+
+	if _, e := db.ExecContext(ctx, `
+		CREATE TABLE parent (id serial PRIMARY KEY);
+		CREATE TABLE audit (id serial PRIMARY KEY, parent_id int CONSTRAINT audit_parent REFERENCES parent (id));
+		CREATE SCHEMA other;
+		CREATE TABLE other.note (parent_id int REFERENCES parent (id));
+
+		INSERT INTO parent DEFAULT VALUES;
+		INSERT INTO audit (parent_id) VALUES (1);
+		INSERT INTO other.note VALUES (1)`); e != nil {
+		t.Fatal(e)
+	}
+
+	for _, c := range []struct {
+		name string
+		opt  *ResetOptions
+		want string
+	}{
+		{"excluded", &ResetOptions{Exclude: []string{"audit", "other.note"}}, "public.audit (audit_parent) references public.parent"},
+		{"other schema", &ResetOptions{Schemas: []string{"public"}}, "other.note"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			e := g.Reset(ctx, g.username, c.opt)
+			if e == nil || !strings.Contains(e.Error(), c.want) {
+				t.Fatalf("got %v, want an error naming %s", e, c.want)
+			}
+
+			for _, table := range []string{"parent", "audit", "other.note"} {
+				if n := queryInt(t, db, "SELECT count(*) FROM "+table); n != 1 {
+					t.Fatalf("%d rows in %s after a refused reset, want 1", n, table)
+				}
+			}
+		})
+	}
+
+	// excluding the referenced table too leaves both alone
+	if e := g.Reset(ctx, g.username, &ResetOptions{Exclude: []string{"parent", "audit", "other.note"}}); e != nil {
+		t.Fatal(e)
+	}
+}
@@ -0,0 +1,376 @@
+package gpgsql
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	sharedLockFile  = "lock"
+	sharedStateFile = "state.json"
+	sharedDataDir   = "data"
+
+	// servers shared between processes, in the cache directory
+	sharedDirName = "shared"
+
+	// shared directory of the server a reaper process watches
+	sharedReaperEnv = "GPGSQL_SHARED_REAPER"
+)
+
+var (
+	defaultSharedOptions = &SharedOptions{
+		Name: "default",
+	}
+
+	// how often the reaper looks at the leases
+	sharedReaperInterval = time.Second
+)
+
+// a reaper is a copy of the program started by Share, it watches the
+// server instead of running main
+func init() {
+	if dir := os.Getenv(sharedReaperEnv); dir != "" {
+		os.Unsetenv(sharedReaperEnv)
+		reapShared(dir)
+		os.Exit(0)
+	}
+}
+
+type SharedOptions struct {
+	Name        string             // processes using the same name share one server
+	Initdb      *InitdbOptions     // used when the server is started on a fresh cluster
+	Server      *PostgreSqlOptions // used when the server is started
+	IdleTimeout time.Duration      // how long the server keeps running without leases
+}
+
+// sharedState is the state file next to the lock, written while
+// holding the lock only.
+type sharedState struct {
+	Leases      []sharedLease `json:"leases"`                 // processes using the server
+	DSN         string        `json:"dsn,omitempty"`          // database named after the user, like Instance.DSN
+	BinaryDir   string        `json:"binary_dir,omitempty"`   // binaries the reaper stops the server with
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"` // of the latest Share
+	IdleSince   time.Time     `json:"idle_since"`             // when the last lease went away, zero while leased
+	Reaper      int           `json:"reaper,omitempty"`       // pid of the reaper process
+}
+
+type sharedLease struct {
+	ID  string `json:"id"`
+	PID int    `json:"pid"`
+}
+
+// SharedServer is a lease on a server shared between processes,
+// for example the test binaries of go test ./... running in parallel.
+type SharedServer struct {
+	g     *GpgsqlRuntime
+	dir   string
+	lease string
+
+	releaseOnce sync.Once
+	releaseErr  error
+}
+
+// Share takes a lease on the shared server named opt.Name, starting it
+// through pg_ctl on a fresh cluster when no process runs it yet, so it
+// outlives the process that started it. Username, password and logger
+// of g are used, its data directory is not. Processes attach through
+// the postmaster.pid of the shared data directory, the state file next
+// to it holds the DSN.
+//
+// Share also starts a reaper, a detached copy of the running program
+// that stops the server once no live process held a lease for
+// IdleTimeout, also when every lessee died without releasing, e.g. go
+// test interrupted. The reaper runs from an init function of this
+// package before main, so programs using Share must not fail or block
+// in init functions running earlier.
+func (g *GpgsqlRuntime) Share(ctx context.Context, opts ...*SharedOptions) (*SharedServer, error) {
+	if len(opts) < 1 || opts[0] == nil {
+		opts = append(opts[:0], defaultSharedOptions)
+	}
+
+	opt := opts[0]
+
+	name := opt.Name
+	if name == "" {
+		name = defaultSharedOptions.Name
+	}
+
+	// a server of another version must not be attached to
+	dir := filepath.Join(g.cacheDir, sharedDirName, name+"_"+g.version)
+	if e := os.MkdirAll(dir, os.ModePerm); e != nil {
+		return nil, fmt.Errorf("failed to create shared directory: %s", e.Error())
+	}
+
+	lock, e := lockFile(filepath.Join(dir, sharedLockFile))
+	if e != nil {
+		return nil, e
+	}
+	defer lock.Unlock()
+
+	state := readSharedState(dir)
+
+	s := &SharedServer{
+		g: &GpgsqlRuntime{
+			host:      g.host,
+			username:  g.username,
+			password:  g.password,
+			data:      filepath.Join(dir, sharedDataDir),
+			logger:    g.logger,
+			binaryDir: g.binaryDir,
+			cacheDir:  g.cacheDir,
+			version:   g.version,
+		},
+		dir: dir,
+	}
+
+	status, e := s.g.Status(ctx)
+	if e != nil {
+		return nil, fmt.Errorf("failed to get status: %s", e.Error())
+	}
+
+	// nobody runs the server, start over instead of trusting old data
+	if status.State == StateStopped || status.State == StateStalePid {
+		if e := os.RemoveAll(s.g.data); e != nil {
+			return nil, fmt.Errorf("failed to remove old data directory: %s", e.Error())
+		}
+	}
+
+	if _, e := s.g.EnsureReady(ctx, &ReadySpec{
+		Initdb:   opt.Initdb,
+		Server:   opt.Server,
+		Template: true,
+	}); e != nil {
+		return nil, e
+	}
+
+	if s.lease, e = newLeaseID(); e != nil {
+		return nil, e
+	}
+
+	state.Leases = append(state.Leases, sharedLease{ID: s.lease, PID: os.Getpid()})
+	state.DSN = s.g.DSN(s.g.username)
+	state.BinaryDir = s.g.binaryDir
+	state.IdleTimeout = opt.IdleTimeout
+	state.IdleSince = time.Time{}
+
+	if !processAlive(state.Reaper) {
+		if state.Reaper, e = startReaper(dir); e != nil {
+			return nil, e
+		}
+	}
+
+	if e := writeSharedState(dir, state); e != nil {
+		return nil, e
+	}
+
+	return s, nil
+}
+
+// Release gives the lease back without waiting for anything. The reaper
+// stops the server once no lease was taken for IdleTimeout, without
+// IdleTimeout or a reaper the last Release stops it right away. Later
+// calls return the result of the first.
+func (s *SharedServer) Release(ctx context.Context) error {
+	s.releaseOnce.Do(func() {
+		s.releaseErr = s.release(ctx)
+	})
+
+	return s.releaseErr
+}
+
+func (s *SharedServer) release(ctx context.Context) error {
+	lock, e := lockFile(filepath.Join(s.dir, sharedLockFile))
+	if e != nil {
+		return e
+	}
+	defer lock.Unlock()
+
+	state := readSharedState(s.dir)
+
+	leases := state.Leases[:0]
+	for _, l := range state.Leases {
+		if l.ID != s.lease {
+			leases = append(leases, l)
+		}
+	}
+
+	state.Leases = leases
+
+	if len(leases) > 0 {
+		return writeSharedState(s.dir, state)
+	}
+
+	if state.IdleTimeout > 0 && processAlive(state.Reaper) {
+		state.IdleSince = time.Now()
+		return writeSharedState(s.dir, state)
+	}
+
+	return stopShared(ctx, s.g, s.dir)
+}
+
+// Runtime returns the runtime connected to the shared server.
+func (s *SharedServer) Runtime() *GpgsqlRuntime {
+	return s.g
+}
+
+func (s *SharedServer) DSN(dbname string) string {
+	return s.g.DSN(dbname)
+}
+
+func (s *SharedServer) DB(dbname string) (*sql.DB, error) {
+	return s.g.DB(dbname)
+}
+
+// stopShared stops the shared server in dir and starts over with an
+// empty state, it runs while holding the lock.
+func stopShared(ctx context.Context, g *GpgsqlRuntime, dir string) error {
+	if e := g.Stop(ctx); e != nil {
+		return e
+	}
+
+	if e := os.RemoveAll(g.data); e != nil {
+		return fmt.Errorf("failed to remove data directory: %s", e.Error())
+	}
+
+	return writeSharedState(dir, &sharedState{})
+}
+
+// startReaper starts the reaper of the shared server in dir, detached
+// so it outlives us and the signals of our terminal.
+func startReaper(dir string) (int, error) {
+	exe, e := os.Executable()
+	if e != nil {
+		return 0, fmt.Errorf("failed to start reaper: %s", e.Error())
+	}
+
+	cmd := exec.Command(exe)
+	cmd.Env = append(os.Environ(), sharedReaperEnv+"="+dir)
+	cmd.Dir = dir
+	cmd.SysProcAttr = detachSysProcAttr()
+
+	if e := cmd.Start(); e != nil {
+		return 0, fmt.Errorf("failed to start reaper: %s", e.Error())
+	}
+
+	// collects its exit status when it ends before us
+	go cmd.Wait()
+
+	return cmd.Process.Pid, nil
+}
+
+// reapShared runs in the reaper process until the server in dir is
+// stopped or another reaper took over.
+func reapShared(dir string) {
+	for !reapOnce(dir) {
+		time.Sleep(sharedReaperInterval)
+	}
+}
+
+// reapOnce stops the shared server in dir when no live process held a
+// lease for IdleTimeout, and reports whether the reaper is done.
+func reapOnce(dir string) bool {
+	lock, e := lockFile(filepath.Join(dir, sharedLockFile))
+	if e != nil {
+		return true
+	}
+	defer lock.Unlock()
+
+	state := readSharedState(dir)
+
+	switch {
+	case state.Reaper != os.Getpid():
+		return true
+	case len(state.Leases) > 0:
+		if !state.IdleSince.IsZero() {
+			state.IdleSince = time.Time{}
+			return writeSharedState(dir, state) != nil
+		}
+
+		return false
+	case state.IdleSince.IsZero():
+		// the lessees died without Release
+		state.IdleSince = time.Now()
+		return writeSharedState(dir, state) != nil
+	case time.Since(state.IdleSince) < state.IdleTimeout:
+		return false
+	}
+
+	g := &GpgsqlRuntime{
+		data:      filepath.Join(dir, sharedDataDir),
+		binaryDir: state.BinaryDir,
+	}
+
+	stopShared(context.Background(), g, dir)
+	return true
+}
+
+// readSharedState reads the state file without the leases of dead
+// processes, a missing or damaged file is an empty state.
+func readSharedState(dir string) *sharedState {
+	state := &sharedState{}
+
+	b, e := os.ReadFile(filepath.Join(dir, sharedStateFile))
+	if e != nil || json.Unmarshal(b, state) != nil {
+		return &sharedState{}
+	}
+
+	leases := state.Leases[:0]
+	for _, l := range state.Leases {
+		if l.PID == os.Getpid() || processAlive(l.PID) {
+			leases = append(leases, l)
+		}
+	}
+
+	state.Leases = leases
+	return state
+}
+
+// writeSharedState replaces the state file, readers never see a
+// partially written one.
+func writeSharedState(dir string, state *sharedState) error {
+	b, e := json.MarshalIndent(state, "", "  ")
+	if e != nil {
+		return e
+	}
+
+	f, e := os.CreateTemp(dir, sharedStateFile+".tmp-*")
+	if e != nil {
+		return fmt.Errorf("failed to write shared state: %s", e.Error())
+	}
+
+	defer os.Remove(f.Name())
+
+	if _, e := f.Write(b); e != nil {
+		f.Close()
+		return fmt.Errorf("failed to write shared state: %s", e.Error())
+	}
+
+	if e := f.Close(); e != nil {
+		return fmt.Errorf("failed to write shared state: %s", e.Error())
+	}
+
+	if e := os.Rename(f.Name(), filepath.Join(dir, sharedStateFile)); e != nil {
+		return fmt.Errorf("failed to write shared state: %s", e.Error())
+	}
+
+	return nil
+}
+
+func newLeaseID() (string, error) {
+	b := make([]byte, 8)
+	if _, e := rand.Read(b); e != nil {
+		return "", errors.New("failed to generate lease id")
+	}
+
+	return hex.EncodeToString(b), nil
+}
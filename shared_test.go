@@ -0,0 +1,269 @@
+package gpgsql
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShareTwice(t *testing.T) {
+	g := testRuntime(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	opt := &SharedOptions{
+		Name:   fmt.Sprintf("test_%d", os.Getpid()),
+		Initdb: &InitdbOptions{Encoding: "UTF8", NoLocale: true, AuthMethod: "trust"},
+	}
+
+	first, e := g.Share(ctx, opt)
+	if e != nil {
+		t.Fatalf("first Share: %s", e.Error())
+	}
+	defer first.Release(ctx)
+
+	// attaches to the running server, its cluster must be recognized
+	second, e := g.Share(ctx, opt)
+	if e != nil {
+		t.Fatalf("second Share: %s", e.Error())
+	}
+	defer second.Release(ctx)
+
+	if first.DSN(maintenanceDatabase) != second.DSN(maintenanceDatabase) {
+		t.Fatalf("leases on different servers: %s and %s", first.DSN(maintenanceDatabase), second.DSN(maintenanceDatabase))
+	}
+
+	db, e := second.DB(maintenanceDatabase)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer db.Close()
+
+	if e := db.PingContext(ctx); e != nil {
+		t.Fatalf("ping: %s", e.Error())
+	}
+
+	if e := first.Release(ctx); e != nil {
+		t.Fatalf("first Release: %s", e.Error())
+	}
+
+	if e := db.PingContext(ctx); e != nil {
+		t.Fatalf("server stopped while leased: %s", e.Error())
+	}
+
+	if e := second.Release(ctx); e != nil {
+		t.Fatalf("second Release: %s", e.Error())
+	}
+
+	status, e := second.Runtime().Status(ctx)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if status.State != StateStopped {
+		t.Fatalf("server %s after the last Release", status.State)
+	}
+}
+
+// testShared returns a shared directory whose data directory no server
+// runs on, stopping it only removes the data.
+func testShared(t *testing.T, state *sharedState) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	data := filepath.Join(dir, sharedDataDir)
+
+	if e := os.MkdirAll(data, 0700); e != nil {
+		t.Fatal(e)
+	}
+
+	if e := writeSharedState(dir, state); e != nil {
+		t.Fatal(e)
+	}
+
+	return dir, data
+}
+
+func TestReapOnce(t *testing.T) {
+	self := os.Getpid()
+	dead := deadPid(t)
+	idle := time.Now().Add(-time.Minute)
+
+	for _, c := range []struct {
+		name    string
+		state   *sharedState
+		done    bool
+		stopped bool
+		idle    bool // IdleSince set afterwards
+	}{
+		{"leased", &sharedState{Reaper: self, Leases: []sharedLease{{ID: "a", PID: self}}}, false, false, false},
+		{"leased again", &sharedState{Reaper: self, Leases: []sharedLease{{ID: "a", PID: self}}, IdleSince: idle}, false, false, false},
+		{"lessees died", &sharedState{Reaper: self, Leases: []sharedLease{{ID: "a", PID: dead}}, IdleTimeout: time.Hour}, false, false, true},
+		{"idle", &sharedState{Reaper: self, IdleSince: time.Now(), IdleTimeout: time.Hour}, false, false, true},
+		{"idle timeout passed", &sharedState{Reaper: self, IdleSince: idle, IdleTimeout: time.Second}, true, true, false},
+		{"without idle timeout", &sharedState{Reaper: self, IdleSince: time.Now()}, true, true, false},
+		{"taken over", &sharedState{Reaper: dead, IdleSince: idle}, true, false, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir, data := testShared(t, c.state)
+
+			if done := reapOnce(dir); done != c.done {
+				t.Fatalf("done %t, want %t", done, c.done)
+			}
+
+			if _, e := os.Stat(data); os.IsNotExist(e) != c.stopped {
+				t.Fatalf("data directory removed %t, want %t", os.IsNotExist(e), c.stopped)
+			}
+
+			state := readSharedState(dir)
+
+			if !state.IdleSince.IsZero() != c.idle {
+				t.Fatalf("idle since %s, want idle %t", state.IdleSince, c.idle)
+			}
+
+			if c.stopped && state.Reaper != 0 {
+				t.Fatalf("reaper %d left in the state of a stopped server", state.Reaper)
+			}
+		})
+	}
+}
+
+// Release hands the idle wait to the reaper and returns right away
+func TestReleaseIdle(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		state   *sharedState
+		stopped bool
+	}{
+		{"reaper waits", &sharedState{IdleTimeout: time.Hour, Reaper: os.Getpid()}, false},
+		{"without idle timeout", &sharedState{Reaper: os.Getpid()}, true},
+		{"reaper died", &sharedState{IdleTimeout: time.Hour, Reaper: deadPid(t)}, true},
+		{"other lease", &sharedState{Leases: []sharedLease{{ID: "other", PID: os.Getpid()}}}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			c.state.Leases = append(c.state.Leases, sharedLease{ID: "own", PID: os.Getpid()})
+			dir, data := testShared(t, c.state)
+
+			s := &SharedServer{g: &GpgsqlRuntime{data: data}, dir: dir, lease: "own"}
+
+			start := time.Now()
+
+			if e := s.Release(context.Background()); e != nil {
+				t.Fatal(e)
+			}
+
+			if d := time.Since(start); d > 5*time.Second {
+				t.Fatalf("Release took %s", d)
+			}
+
+			if _, e := os.Stat(data); os.IsNotExist(e) != c.stopped {
+				t.Fatalf("stopped %t, want %t", os.IsNotExist(e), c.stopped)
+			}
+
+			state := readSharedState(dir)
+
+			for _, l := range state.Leases {
+				if l.ID == "own" {
+					t.Fatal("lease left after Release")
+				}
+			}
+
+			if !c.stopped && len(state.Leases) < 1 && state.IdleSince.IsZero() {
+				t.Fatal("idle since not recorded for the reaper")
+			}
+		})
+	}
+}
+
+// the reaper is a copy of the test binary, it stops the server of
+// lessees that died without Release and exits
+func TestReaper(t *testing.T) {
+	dir, data := testShared(t, &sharedState{})
+
+	lock, e := lockFile(filepath.Join(dir, sharedLockFile))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	pid, e := startReaper(dir)
+	if e != nil {
+		lock.Unlock()
+		t.Fatal(e)
+	}
+
+	e = writeSharedState(dir, &sharedState{Reaper: pid, Leases: []sharedLease{{ID: "gone", PID: deadPid(t)}}})
+	lock.Unlock()
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	for deadline := time.Now().Add(30 * time.Second); processAlive(pid); {
+		if time.Now().After(deadline) {
+			t.Fatal("reaper still running")
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if _, e := os.Stat(data); !os.IsNotExist(e) {
+		t.Fatalf("data directory left by the reaper: %v", e)
+	}
+
+	if state := readSharedState(dir); state.Reaper != 0 {
+		t.Fatalf("reaper %d left in the state", state.Reaper)
+	}
+}
+
+// the last Release returns at once, the reaper stops the server after
+// the idle timeout
+func TestShareIdleTimeout(t *testing.T) {
+	g := testRuntime(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	s, e := g.Share(ctx, &SharedOptions{
+		Name:        fmt.Sprintf("idle_%d", os.Getpid()),
+		Initdb:      &InitdbOptions{Encoding: "UTF8", NoLocale: true, AuthMethod: "trust"},
+		IdleTimeout: 500 * time.Millisecond,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	state := readSharedState(s.dir)
+
+	if state.DSN != s.DSN(s.g.username) || !processAlive(state.Reaper) {
+		t.Fatalf("state has dsn %q and reaper %d, want %q and a live reaper", state.DSN, state.Reaper, s.DSN(s.g.username))
+	}
+
+	start := time.Now()
+
+	if e := s.Release(ctx); e != nil {
+		t.Fatal(e)
+	}
+
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("Release took %s", d)
+	}
+
+	for deadline := time.Now().Add(time.Minute); ; time.Sleep(100 * time.Millisecond) {
+		status, e := s.Runtime().Status(ctx)
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		if status.State == StateStopped {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("server %s long after the idle timeout", status.State)
+		}
+	}
+}
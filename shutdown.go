@@ -0,0 +1,156 @@
+package gpgsql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	ShutdownSmart     ShutdownMode = "smart"     // wait for all clients to disconnect
+	ShutdownFast      ShutdownMode = "fast"      // disconnect clients and shut down cleanly
+	ShutdownImmediate ShutdownMode = "immediate" // quit without a clean shutdown, recovery on next start
+)
+
+var (
+	// same as the pg_ctl default
+	defaultShutdownTimeout = 60 * time.Second
+)
+
+// ShutdownMode is the postgres shutdown mode, the same values
+// as PgCliOptions.Mode accepts.
+type ShutdownMode string
+
+func (m ShutdownMode) valid() error {
+	switch m {
+	case ShutdownSmart, ShutdownFast, ShutdownImmediate:
+		return nil
+	}
+
+	return fmt.Errorf("unknown shutdown mode: %q", string(m))
+}
+
+// process is a postmaster started directly by Daemon.
+type process struct {
+	g    *GpgsqlRuntime
+	cmd  *exec.Cmd
+	done chan struct{}
+	err  error // exit status, valid after done is closed
+
+	stopOnce sync.Once
+	stopErr  error
+}
+
+// startProcess starts cmd and waits for it in the background,
+// after is called once the process has exited. Start and Wait run on
+// one goroutine locked to its OS thread until the process exits: the
+// Pdeathsig of daemonSysProcAttr fires when the thread that started the
+// process ends, not the whole program, and the go runtime ends threads
+// whose goroutine exits while locked.
+func (g *GpgsqlRuntime) startProcess(cmd *exec.Cmd, after func()) (*process, error) {
+	p := &process{
+		g:    g,
+		cmd:  cmd,
+		done: make(chan struct{}),
+	}
+
+	started := make(chan error, 1)
+
+	go func() {
+		// never unlocked, the thread ends with the process
+		runtime.LockOSThread()
+
+		if e := cmd.Start(); e != nil {
+			started <- e
+			return
+		}
+
+		started <- nil
+		e := cmd.Wait()
+
+		if after != nil {
+			after()
+		}
+
+		p.err = e
+		close(p.done)
+	}()
+
+	if e := <-started; e != nil {
+		return nil, e
+	}
+
+	return p, nil
+}
+
+func (p *process) pid() int {
+	return p.cmd.Process.Pid
+}
+
+// shutdown asks the postmaster to stop in the given mode and waits
+// for it to exit. When ctx is done first, or has no deadline and
+// defaultShutdownTimeout passes, the process is killed.
+func (p *process) shutdown(ctx context.Context, mode ShutdownMode) error {
+	if mode == "" {
+		mode = ShutdownFast
+	}
+
+	if e := mode.valid(); e != nil {
+		return e
+	}
+
+	p.stopOnce.Do(func() {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, defaultShutdownTimeout)
+			defer cancel()
+		}
+
+		select {
+		case <-p.done:
+		default:
+			if e := p.g.signal(ctx, p.pid(), mode); e != nil {
+				select {
+				case <-p.done:
+				default:
+					p.stopErr = fmt.Errorf("failed to signal postgres: %s", e.Error())
+					return
+				}
+			}
+		}
+
+		select {
+		case <-p.done:
+			p.stopErr = p.exitError()
+		case <-ctx.Done():
+			if e := p.cmd.Process.Kill(); e != nil {
+				p.stopErr = fmt.Errorf("failed to kill postgres: %s", e.Error())
+				return
+			}
+
+			<-p.done
+			p.stopErr = fmt.Errorf("postgres %s shutdown did not finish in time, killed: %s",
+				mode, ctx.Err().Error())
+		}
+	})
+
+	return p.stopErr
+}
+
+// exitError reports the exit status of the finished process.
+func (p *process) exitError() error {
+	if p.err == nil {
+		return nil
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(p.err, &exitErr) {
+		return fmt.Errorf("postgres exited: %s", exitErr.Error())
+	}
+
+	return p.err
+}
@@ -0,0 +1,162 @@
+//go:build !windows
+
+package gpgsql
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startSleep stands in for a postmaster with sleep, with ignoreTerm it
+// ignores SIGTERM like a smart shutdown waiting for its clients.
+func startSleep(t *testing.T, ignoreTerm bool) *process {
+	t.Helper()
+
+	cmd := exec.Command("sleep", "60")
+
+	var ready *os.File
+
+	if ignoreTerm {
+		r, w, e := os.Pipe()
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer w.Close()
+
+		// ignored signals stay ignored across exec
+		cmd = exec.Command("sh", "-c", `trap "" TERM; echo ready; exec sleep 60`)
+		cmd.Stdout = w
+		ready = r
+	}
+
+	p, e := (&GpgsqlRuntime{}).startProcess(cmd, nil)
+	if e != nil {
+		t.Skip(e.Error())
+	}
+
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		<-p.done
+	})
+
+	if ready != nil {
+		defer ready.Close()
+
+		if _, e := bufio.NewReader(ready).ReadString('\n'); e != nil {
+			t.Fatalf("failed to wait for the trap: %s", e.Error())
+		}
+	}
+
+	return p
+}
+
+// exitSignal returns the signal that ended the process.
+func exitSignal(t *testing.T, p *process) syscall.Signal {
+	t.Helper()
+
+	status, ok := p.cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		t.Fatalf("process not ended by a signal: %s", p.cmd.ProcessState)
+	}
+
+	return status.Signal()
+}
+
+func TestShutdownSignals(t *testing.T) {
+	for _, c := range []struct {
+		mode ShutdownMode
+		want syscall.Signal
+	}{
+		{ShutdownSmart, syscall.SIGTERM},
+		{ShutdownFast, syscall.SIGINT},
+		{ShutdownImmediate, syscall.SIGQUIT},
+		{"", syscall.SIGINT}, // fast by default
+	} {
+		t.Run("mode "+string(c.mode), func(t *testing.T) {
+			p := startSleep(t, false)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			if e := p.shutdown(ctx, c.mode); e != nil && strings.Contains(e.Error(), "killed") {
+				t.Fatal(e)
+			}
+
+			if s := exitSignal(t, p); s != c.want {
+				t.Fatalf("%q sent %s, want %s", c.mode, s, c.want)
+			}
+		})
+	}
+}
+
+func TestShutdownInvalidMode(t *testing.T) {
+	p := startSleep(t, false)
+
+	if e := p.shutdown(context.Background(), "graceful"); e == nil {
+		t.Fatal("no error for an unknown mode")
+	}
+
+	select {
+	case <-p.done:
+		t.Fatal("process stopped for an unknown mode")
+	default:
+	}
+}
+
+// a postmaster ignoring the shutdown signal is killed once ctx is done
+func TestShutdownKill(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+		err  string
+	}{
+		{"timeout", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 200*time.Millisecond)
+		}, "deadline exceeded"},
+		{"canceled", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(200*time.Millisecond, cancel)
+			return ctx, cancel
+		}, "canceled"},
+		{"no deadline", func() (context.Context, context.CancelFunc) {
+			timeout := defaultShutdownTimeout
+			defaultShutdownTimeout = 200 * time.Millisecond
+			t.Cleanup(func() { defaultShutdownTimeout = timeout })
+
+			return context.Background(), func() {}
+		}, "deadline exceeded"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			p := startSleep(t, true)
+
+			ctx, cancel := c.ctx()
+			defer cancel()
+
+			start := time.Now()
+
+			e := p.shutdown(ctx, ShutdownSmart)
+			if e == nil || !strings.Contains(e.Error(), "killed") || !strings.Contains(e.Error(), c.err) {
+				t.Fatalf("got %v, want killed after %s", e, c.err)
+			}
+
+			if d := time.Since(start); d > 10*time.Second {
+				t.Fatalf("shutdown took %s", d)
+			}
+
+			if s := exitSignal(t, p); s != syscall.SIGKILL {
+				t.Fatalf("ended by %s, want %s", s, syscall.SIGKILL)
+			}
+
+			// later calls report the same result without signaling again
+			if again := p.shutdown(context.Background(), ShutdownFast); again != e {
+				t.Fatalf("second shutdown gave %v, want %v", again, e)
+			}
+		})
+	}
+}
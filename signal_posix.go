@@ -0,0 +1,38 @@
+//go:build !windows
+
+package gpgsql
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+)
+
+var (
+	shutdownSignals = map[ShutdownMode]os.Signal{
+		ShutdownSmart:     syscall.SIGTERM,
+		ShutdownFast:      syscall.SIGINT,
+		ShutdownImmediate: syscall.SIGQUIT,
+	}
+)
+
+// signal sends the shutdown signal of mode to the postmaster pid.
+func (g *GpgsqlRuntime) signal(ctx context.Context, pid int, mode ShutdownMode) error {
+	p, e := os.FindProcess(pid)
+	if e != nil {
+		return e
+	}
+
+	return p.Signal(shutdownSignals[mode])
+}
+
+// processAlive reports whether a process with pid exists.
+func processAlive(pid int) bool {
+	if pid < 1 {
+		return false
+	}
+
+	e := syscall.Kill(pid, 0)
+	return e == nil || errors.Is(e, syscall.EPERM)
+}
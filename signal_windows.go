@@ -0,0 +1,49 @@
+//go:build windows
+
+package gpgsql
+
+import (
+	"context"
+	"strconv"
+	"syscall"
+)
+
+const (
+	stillActive = 259 // STILL_ACTIVE exit code of running processes
+)
+
+var (
+	// windows has no posix signals, pg_ctl emulates them for postgres
+	shutdownSignals = map[ShutdownMode]string{
+		ShutdownSmart:     "TERM",
+		ShutdownFast:      "INT",
+		ShutdownImmediate: "QUIT",
+	}
+)
+
+// signal sends the shutdown signal of mode to the postmaster pid.
+func (g *GpgsqlRuntime) signal(ctx context.Context, pid int, mode ShutdownMode) error {
+	return g.PgCli(ctx, CliKill, &PgCliOptions{
+		Args: []string{shutdownSignals[mode], strconv.Itoa(pid)},
+	})
+}
+
+// processAlive reports whether a process with pid exists.
+func processAlive(pid int) bool {
+	if pid < 1 {
+		return false
+	}
+
+	h, e := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if e != nil {
+		return false
+	}
+	defer syscall.CloseHandle(h)
+
+	var code uint32
+	if e := syscall.GetExitCodeProcess(h, &code); e != nil {
+		return false
+	}
+
+	return code == stillActive
+}
@@ -0,0 +1,236 @@
+package gpgsql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	StateStopped  ServerState = iota // no postmaster.pid
+	StateRunning                     // accepting connections
+	StateStarting                    // postmaster is starting up
+	StateStopping                    // postmaster is shutting down
+	StateStalePid                    // postmaster.pid left behind by a dead server
+)
+
+const (
+	postmasterPidFile = "postmaster.pid"
+)
+
+var (
+	serverStates = []string{"stopped", "running", "starting", "stopping", "stale pid"}
+)
+
+type ServerState uint8
+
+func (s ServerState) String() string {
+	if len(serverStates) <= int(s) {
+		return ""
+	}
+
+	return serverStates[s]
+}
+
+// PostmasterPid is the content of the postmaster.pid lock file,
+// fields the postmaster has not written yet are left empty.
+type PostmasterPid struct {
+	PID        int       // postmaster process id
+	DataDir    string    // data directory
+	StartTime  time.Time // postmaster start time
+	Port       uint16    // port number
+	SocketDir  string    // first unix socket directory
+	ListenAddr string    // first listen address, "*" for all
+	ShmKey     string    // shared memory key and id
+	Status     string    // "starting", "stopping", "ready" or "standby"
+}
+
+type ServerStatus struct {
+	State ServerState
+	Pid   *PostmasterPid // nil when there is no postmaster.pid
+}
+
+// ParsePostmasterPid parses the content of a postmaster.pid file.
+func ParsePostmasterPid(b []byte) (*PostmasterPid, error) {
+	lines := strings.Split(strings.ReplaceAll(string(b), "\r\n", "\n"), "\n")
+
+	line := func(n int) string {
+		if len(lines) < n {
+			return ""
+		}
+
+		return strings.TrimSpace(lines[n-1])
+	}
+
+	pid, e := strconv.Atoi(line(1))
+	if e != nil {
+		return nil, fmt.Errorf("invalid pid: %s", e.Error())
+	}
+
+	p := &PostmasterPid{
+		PID:        pid,
+		DataDir:    line(2),
+		SocketDir:  line(5),
+		ListenAddr: line(6),
+		ShmKey:     strings.Join(strings.Fields(line(7)), " "),
+		Status:     line(8),
+	}
+
+	if v := line(3); v != "" {
+		sec, e := strconv.ParseInt(v, 10, 64)
+		if e != nil {
+			return nil, fmt.Errorf("invalid start time: %s", e.Error())
+		}
+
+		p.StartTime = time.Unix(sec, 0)
+	}
+
+	if v := line(4); v != "" {
+		port, e := strconv.ParseUint(v, 10, 16)
+		if e != nil {
+			return nil, fmt.Errorf("invalid port: %s", e.Error())
+		}
+
+		p.Port = uint16(port)
+	}
+
+	return p, nil
+}
+
+// readPostmasterPid reads the postmaster.pid lock file of the data directory.
+func readPostmasterPid(data string) (*PostmasterPid, error) {
+	b, e := os.ReadFile(filepath.Join(data, postmasterPidFile))
+	if e != nil {
+		return nil, e
+	}
+
+	p, e := ParsePostmasterPid(b)
+	if e != nil {
+		return nil, fmt.Errorf("invalid %s: %s", postmasterPidFile, e.Error())
+	}
+
+	return p, nil
+}
+
+// Status reports the state of the server in the data directory
+// from its postmaster.pid, without running pg_ctl.
+func (g *GpgsqlRuntime) Status(ctx context.Context) (*ServerStatus, error) {
+	// postmaster.pid would be looked up in the working directory
+	if strings.TrimSpace(g.data) == "" {
+		return nil, errors.New("data directory is empty")
+	}
+
+	p, e := readPostmasterPid(g.data)
+	if errors.Is(e, os.ErrNotExist) {
+		return &ServerStatus{State: StateStopped}, nil
+	}
+
+	if e != nil {
+		return nil, e
+	}
+
+	status := &ServerStatus{Pid: p}
+
+	switch {
+	case !postmasterAlive(p):
+		status.State = StateStalePid
+	case p.Status == "stopping":
+		status.State = StateStopping
+	case p.Status == "ready" || p.Status == "standby":
+		status.State = StateRunning
+	default:
+		status.State = StateStarting
+	}
+
+	return status, nil
+}
+
+// postmasterAlive reports whether the server that wrote p still runs.
+func postmasterAlive(p *PostmasterPid) bool {
+	if p.PID == os.Getpid() {
+		return false
+	}
+
+	return processAlive(p.PID) && isPostmaster(p)
+}
+
+// recoverStalePid makes sure no live server uses the data directory,
+// and removes the postmaster.pid left behind by a dead one.
+func (g *GpgsqlRuntime) recoverStalePid(ctx context.Context) error {
+	status, e := g.Status(ctx)
+	if e != nil {
+		return fmt.Errorf("failed to get status: %s", e.Error())
+	}
+
+	switch status.State {
+	case StateStopped:
+		return nil
+	case StateStalePid:
+		if e := os.Remove(filepath.Join(g.data, postmasterPidFile)); e != nil && !errors.Is(e, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove stale %s: %s", postmasterPidFile, e.Error())
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s by pid %d", ErrDataDirLocked, status.State, status.Pid.PID)
+}
+
+// Attach points the runtime at the server already running on the data
+// directory, taking its port and address from postmaster.pid, so DSN,
+// DB and Stop work against it instead of starting a second server.
+func (g *GpgsqlRuntime) Attach(ctx context.Context) (*Instance, error) {
+	status, e := g.Status(ctx)
+	if e != nil {
+		return nil, fmt.Errorf("failed to get status: %s", e.Error())
+	}
+
+	if status.State != StateRunning {
+		return nil, fmt.Errorf("server is not running: %s", status.State)
+	}
+
+	p := status.Pid
+
+	host, e := attachHost(p.ListenAddr)
+	if e != nil && p.SocketDir == "" {
+		return nil, e
+	}
+
+	g.host, g.socket, g.port = host, p.SocketDir, p.Port
+
+	if e := g.CheckConnection(ctx); e != nil {
+		return nil, fmt.Errorf("failed to check connection: %s", e.Error())
+	}
+
+	return g.newExternalInstance(p.PID), nil
+}
+
+// attachHost translates the listen address of postmaster.pid
+// into an address we can connect to.
+func attachHost(addr string) (net.IP, error) {
+	switch addr {
+	case "":
+		return nil, errors.New("server is not listening on tcp")
+	case "*", "0.0.0.0", "localhost":
+		return net.IP{127, 0, 0, 1}, nil
+	case "::":
+		return net.IPv6loopback, nil
+	}
+
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip, nil
+	}
+
+	ips, e := net.LookupIP(addr)
+	if e != nil {
+		return nil, fmt.Errorf("failed to resolve listen address: %s", e.Error())
+	}
+
+	return ips[0], nil
+}
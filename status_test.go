@@ -0,0 +1,370 @@
+package gpgsql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePostmaster runs a copy of sleep named postgres, a live process
+// that passes for a postmaster, until the test ends.
+func fakePostmaster(t *testing.T) int {
+	t.Helper()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("stands in for postgres with sleep")
+	}
+
+	sleep, e := exec.LookPath("sleep")
+	if e != nil {
+		t.Skip(e.Error())
+	}
+
+	b, e := os.ReadFile(sleep)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	bin := filepath.Join(t.TempDir(), "postgres")
+	if e := os.WriteFile(bin, b, 0755); e != nil {
+		t.Fatal(e)
+	}
+
+	cmd := exec.Command(bin, "60")
+	if e := cmd.Start(); e != nil {
+		t.Fatal(e)
+	}
+
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	return cmd.Process.Pid
+}
+
+// deadPid returns the pid of a process that has exited.
+func deadPid(t *testing.T) int {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if e := cmd.Run(); e != nil {
+		t.Fatal(e)
+	}
+
+	return cmd.Process.Pid
+}
+
+// writePostmasterPid writes a postmaster.pid of pid into data.
+func writePostmasterPid(t *testing.T, data string, pid int, status string) {
+	t.Helper()
+
+	b := fmt.Sprintf("%d\n%s\n1665400000\n5433\n/tmp\n127.0.0.1\n        0         0\n%-8s\n", pid, data, status)
+
+	if e := os.WriteFile(filepath.Join(data, postmasterPidFile), []byte(b), 0600); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestParsePostmasterPid(t *testing.T) {
+	full := &PostmasterPid{
+		PID:        1234,
+		DataDir:    "/var/lib/postgresql/data",
+		StartTime:  time.Unix(1665400000, 0),
+		Port:       5432,
+		SocketDir:  "/tmp",
+		ListenAddr: "*",
+		ShmKey:     "5432001 2",
+		Status:     "ready",
+	}
+
+	for _, c := range []struct {
+		name string
+		file string
+		want *PostmasterPid
+	}{
+		{"full", "1234\n/var/lib/postgresql/data\n1665400000\n5432\n/tmp\n*\n  5432001         2\nready   \n", full},
+		{"crlf", "1234\r\n/var/lib/postgresql/data\r\n1665400000\r\n5432\r\n/tmp\r\n*\r\n  5432001         2\r\nready   \r\n", full},
+		{"starting", "1234\n/var/lib/postgresql/data\n1665400000\n5432\n", &PostmasterPid{
+			PID:       1234,
+			DataDir:   "/var/lib/postgresql/data",
+			StartTime: time.Unix(1665400000, 0),
+			Port:      5432,
+		}},
+		{"pid only", "1234\n", &PostmasterPid{PID: 1234}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			p, e := ParsePostmasterPid([]byte(c.file))
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			if !reflect.DeepEqual(p, c.want) {
+				t.Fatalf("got %+v, want %+v", p, c.want)
+			}
+		})
+	}
+
+	for _, c := range []struct {
+		name string
+		file string
+		want string
+	}{
+		{"empty", "", "invalid pid"},
+		{"garbage pid", "postgres\n/data\n", "invalid pid"},
+		{"start time", "1234\n/data\nyesterday\n", "invalid start time"},
+		{"port", "1234\n/data\n1665400000\n65536\n", "invalid port"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if _, e := ParsePostmasterPid([]byte(c.file)); e == nil || !strings.Contains(e.Error(), c.want) {
+				t.Fatalf("got error %v, want %q", e, c.want)
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	live := fakePostmaster(t)
+	dead := deadPid(t)
+
+	for _, c := range []struct {
+		name   string
+		pid    int
+		status string
+		want   ServerState
+	}{
+		{"stopped", 0, "", StateStopped},
+		{"stale", dead, "ready", StateStalePid},
+		{"own pid", os.Getpid(), "ready", StateStalePid},
+		{"starting", live, "starting", StateStarting},
+		{"partial", live, "", StateStarting},
+		{"running", live, "ready", StateRunning},
+		{"standby", live, "standby", StateRunning},
+		{"stopping", live, "stopping", StateStopping},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			g := &GpgsqlRuntime{data: t.TempDir()}
+
+			if c.pid > 0 {
+				writePostmasterPid(t, g.data, c.pid, c.status)
+			}
+
+			status, e := g.Status(context.Background())
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			if status.State != c.want {
+				t.Fatalf("got %s, want %s", status.State, c.want)
+			}
+
+			if (status.Pid == nil) != (c.pid == 0) || (status.Pid != nil && status.Pid.PID != c.pid) {
+				t.Fatalf("got pid %+v, want %d", status.Pid, c.pid)
+			}
+		})
+	}
+
+	g := &GpgsqlRuntime{data: t.TempDir()}
+
+	if e := os.WriteFile(filepath.Join(g.data, postmasterPidFile), []byte("garbage\n"), 0600); e != nil {
+		t.Fatal(e)
+	}
+
+	if _, e := g.Status(context.Background()); e == nil {
+		t.Fatal("no error for a garbage postmaster.pid")
+	}
+}
+
+func TestAttachNotRunning(t *testing.T) {
+	live := fakePostmaster(t)
+
+	for _, c := range []struct {
+		name   string
+		pid    int
+		status string
+	}{
+		{"stopped", 0, ""},
+		{"stale", deadPid(t), "ready"},
+		{"starting", live, "starting"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			g := &GpgsqlRuntime{data: t.TempDir()}
+
+			if c.pid > 0 {
+				writePostmasterPid(t, g.data, c.pid, c.status)
+			}
+
+			if i, e := g.Attach(context.Background()); e == nil || !strings.Contains(e.Error(), "not running") {
+				t.Fatalf("got %v and %v, want not running", i, e)
+			}
+		})
+	}
+}
+
+func TestAttachHost(t *testing.T) {
+	for _, c := range []struct {
+		addr string
+		want net.IP
+	}{
+		{"*", net.IP{127, 0, 0, 1}},
+		{"0.0.0.0", net.IP{127, 0, 0, 1}},
+		{"localhost", net.IP{127, 0, 0, 1}},
+		{"::", net.IPv6loopback},
+		{"10.1.2.3", net.IP{10, 1, 2, 3}},
+		{"::1", net.IPv6loopback},
+	} {
+		ip, e := attachHost(c.addr)
+		if e != nil {
+			t.Fatalf("%q: %s", c.addr, e.Error())
+		}
+
+		if !ip.Equal(c.want) {
+			t.Fatalf("%q gave %s, want %s", c.addr, ip, c.want)
+		}
+	}
+
+	if _, e := attachHost(""); e == nil {
+		t.Fatal("no error without a tcp listen address")
+	}
+}
+
+// a second runtime adopts the server another runtime started on the
+// same data directory
+func TestAttach(t *testing.T) {
+	owner := testServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	running, e := owner.EnsureReady(ctx, &ReadySpec{Daemon: true})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	g := testRuntime(t)
+
+	if e := g.Data(owner.data); e != nil {
+		t.Fatal(e)
+	}
+
+	i, e := g.Attach(ctx)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if i.PID() != running.PID() {
+		t.Fatalf("attached to pid %d, want %d", i.PID(), running.PID())
+	}
+
+	if i.ListenAddr() != running.ListenAddr() {
+		t.Fatalf("attached to %s, want %s", i.ListenAddr(), running.ListenAddr())
+	}
+
+	if e := g.CheckConnection(ctx); e != nil {
+		t.Fatal(e)
+	}
+
+	select {
+	case <-i.Done():
+		t.Fatalf("attached instance done: %v", i.Err())
+	default:
+	}
+}
+
+func TestRecoverStalePid(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("a reused pid is only told apart from the postmaster on linux")
+	}
+
+	// a live process that is not a postmaster, like one that got
+	// the pid of a crashed server
+	reused := exec.Command("sleep", "60")
+	if e := reused.Start(); e != nil {
+		t.Skip(e.Error())
+	}
+
+	t.Cleanup(func() {
+		reused.Process.Kill()
+		reused.Wait()
+	})
+
+	for _, c := range []struct {
+		name string
+		pid  int
+	}{
+		{"dead", deadPid(t)},
+		{"reused", reused.Process.Pid},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			g := &GpgsqlRuntime{data: t.TempDir()}
+			writePostmasterPid(t, g.data, c.pid, "ready")
+
+			if e := g.recoverStalePid(context.Background()); e != nil {
+				t.Fatal(e)
+			}
+
+			if _, e := os.Stat(filepath.Join(g.data, postmasterPidFile)); !os.IsNotExist(e) {
+				t.Fatalf("stale %s left: %v", postmasterPidFile, e)
+			}
+		})
+	}
+}
+
+func TestDaemonDataDirLocked(t *testing.T) {
+	live := fakePostmaster(t)
+
+	g := &GpgsqlRuntime{host: net.IP{127, 0, 0, 1}, data: t.TempDir()}
+	writePostmasterPid(t, g.data, live, "ready")
+
+	if _, e := g.Daemon(context.Background()); !errors.Is(e, ErrDataDirLocked) {
+		t.Fatalf("got %v, want %v", e, ErrDataDirLocked)
+	}
+
+	if _, e := os.Stat(filepath.Join(g.data, postmasterPidFile)); e != nil {
+		t.Fatalf("%s of a live server removed: %v", postmasterPidFile, e)
+	}
+}
+
+// without a data directory nothing may be recovered, the postmaster.pid
+// of the working directory belongs to someone else
+func TestDaemonWithoutData(t *testing.T) {
+	dir := t.TempDir()
+	writePostmasterPid(t, dir, deadPid(t), "ready")
+
+	wd, e := os.Getwd()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if e := os.Chdir(dir); e != nil {
+		t.Fatal(e)
+	}
+	defer os.Chdir(wd)
+
+	g := &GpgsqlRuntime{host: net.IP{127, 0, 0, 1}}
+
+	if _, e := g.Daemon(context.Background()); e == nil {
+		t.Fatal("no error without data directory")
+	}
+
+	if _, e := g.Start(context.Background()); e == nil {
+		t.Fatal("no error without data directory")
+	}
+
+	if _, e := g.Status(context.Background()); e == nil {
+		t.Fatal("no error without data directory")
+	}
+
+	if _, e := os.Stat(filepath.Join(dir, postmasterPidFile)); e != nil {
+		t.Fatalf("%s of the working directory removed: %v", postmasterPidFile, e)
+	}
+}
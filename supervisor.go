@@ -0,0 +1,276 @@
+package gpgsql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	SupervisorStarted    SupervisorEventType = iota // server started for the first time
+	SupervisorCrashed                               // server exited without Stop
+	SupervisorRestarting                            // waiting to restart the server
+	SupervisorRestarted                             // server is up again
+	SupervisorGaveUp                                // restart budget exhausted
+	SupervisorStopped                               // server stopped through Stop or ctx
+)
+
+var (
+	supervisorEventTypes = []string{"started", "crashed", "restarting", "restarted", "gave up", "stopped"}
+
+	defaultSupervisorOptions = &SupervisorOptions{
+		MaxRestarts: 5,
+		MinBackoff:  500 * time.Millisecond,
+		MaxBackoff:  30 * time.Second,
+		ResetAfter:  time.Minute,
+	}
+)
+
+type SupervisorEventType uint8
+
+func (t SupervisorEventType) String() string {
+	if len(supervisorEventTypes) <= int(t) {
+		return ""
+	}
+
+	return supervisorEventTypes[t]
+}
+
+type SupervisorEvent struct {
+	Type     SupervisorEventType
+	Restarts uint      // restarts since the last reset
+	Instance *Instance // running server, nil unless started or restarted
+	Err      error     // why the server crashed or a restart failed
+}
+
+type SupervisorOptions struct {
+	Server      *PostgreSqlOptions    // server options, used for every start
+	MaxRestarts uint                  // restarts before giving up, 0 means unlimited
+	MinBackoff  time.Duration         // delay before the first restart
+	MaxBackoff  time.Duration         // upper bound of the doubling delay
+	ResetAfter  time.Duration         // uptime after which backoff and budget are reset
+	OnEvent     func(SupervisorEvent) // called from the supervisor goroutine, must not block
+}
+
+// Supervisor keeps a server started by Daemon running, restarting it
+// on the same port and data directory when it dies.
+type Supervisor struct {
+	start func(ctx context.Context) (*Instance, error)
+	opt   *SupervisorOptions
+
+	mu       sync.Mutex
+	instance *Instance
+	stopping bool
+	stop     chan struct{}
+	done     chan struct{}
+	err      error
+}
+
+// Supervise starts the server through Daemon and restarts it with
+// exponential backoff whenever it exits without Stop. Cancelling ctx
+// stops the server and the supervisor.
+func (g *GpgsqlRuntime) Supervise(ctx context.Context, opts ...*SupervisorOptions) (*Supervisor, error) {
+	if len(opts) < 1 || opts[0] == nil {
+		opts = append(opts[:0], defaultSupervisorOptions)
+	}
+
+	opt := *opts[0]
+
+	if opt.MinBackoff < 1 {
+		opt.MinBackoff = defaultSupervisorOptions.MinBackoff
+	}
+
+	if opt.MaxBackoff < opt.MinBackoff {
+		opt.MaxBackoff = opt.MinBackoff
+	}
+
+	return supervise(ctx, &opt, func(ctx context.Context) (*Instance, error) {
+		return g.Daemon(ctx, opt.Server)
+	})
+}
+
+// supervise runs start and keeps restarting what it started,
+// Supervise starts the server through Daemon.
+func supervise(ctx context.Context, opt *SupervisorOptions, start func(ctx context.Context) (*Instance, error)) (*Supervisor, error) {
+	instance, e := start(ctx)
+	if e != nil {
+		return nil, e
+	}
+
+	s := &Supervisor{
+		start:    start,
+		opt:      opt,
+		instance: instance,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	s.emit(SupervisorEvent{Type: SupervisorStarted, Instance: instance})
+
+	go s.run(ctx)
+
+	return s, nil
+}
+
+func (s *Supervisor) emit(evt SupervisorEvent) {
+	if s.opt.OnEvent != nil {
+		s.opt.OnEvent(evt)
+	}
+}
+
+func (s *Supervisor) run(ctx context.Context) {
+	defer close(s.done)
+
+	var (
+		restarts uint
+		backoff  = s.opt.MinBackoff
+	)
+
+	for {
+		instance := s.Instance()
+		started := time.Now()
+
+		<-instance.Done()
+
+		if s.isStopping() || ctx.Err() != nil {
+			s.emit(SupervisorEvent{Type: SupervisorStopped, Restarts: restarts})
+			return
+		}
+
+		crash := instance.Err()
+		if crash == nil {
+			crash = errors.New("postgres exited")
+		}
+
+		s.emit(SupervisorEvent{Type: SupervisorCrashed, Restarts: restarts, Err: crash})
+
+		if s.opt.ResetAfter > 0 && time.Since(started) >= s.opt.ResetAfter {
+			restarts, backoff = 0, s.opt.MinBackoff
+		}
+
+		for {
+			if s.opt.MaxRestarts > 0 && restarts >= s.opt.MaxRestarts {
+				s.finish(fmt.Errorf("gave up after %d restarts: %s", restarts, crash.Error()))
+				s.emit(SupervisorEvent{Type: SupervisorGaveUp, Restarts: restarts, Err: crash})
+				return
+			}
+
+			restarts++
+			s.emit(SupervisorEvent{Type: SupervisorRestarting, Restarts: restarts, Err: crash})
+
+			timer := time.NewTimer(backoff)
+
+			select {
+			case <-timer.C:
+			case <-s.stop:
+			case <-ctx.Done():
+			}
+
+			timer.Stop()
+
+			if s.isStopping() || ctx.Err() != nil {
+				s.emit(SupervisorEvent{Type: SupervisorStopped, Restarts: restarts})
+				return
+			}
+
+			if backoff *= 2; backoff > s.opt.MaxBackoff {
+				backoff = s.opt.MaxBackoff
+			}
+
+			instance, e := s.start(ctx)
+			if e != nil {
+				crash = e
+				continue
+			}
+
+			if !s.setInstance(instance) {
+				instance.Stop(context.Background(), ShutdownFast)
+				s.emit(SupervisorEvent{Type: SupervisorStopped, Restarts: restarts})
+				return
+			}
+
+			s.emit(SupervisorEvent{Type: SupervisorRestarted, Restarts: restarts, Instance: instance})
+			break
+		}
+	}
+}
+
+// setInstance replaces the running instance, it reports false
+// when the supervisor is stopping.
+func (s *Supervisor) setInstance(instance *Instance) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopping {
+		return false
+	}
+
+	s.instance = instance
+	return true
+}
+
+func (s *Supervisor) isStopping() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stopping
+}
+
+func (s *Supervisor) finish(e error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = e
+}
+
+// Instance returns the latest server instance, it may have exited
+// while a restart is pending.
+func (s *Supervisor) Instance() *Instance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.instance
+}
+
+// Stop stops supervising and shuts the server down in the given mode.
+func (s *Supervisor) Stop(ctx context.Context, mode ShutdownMode) error {
+	s.mu.Lock()
+	if !s.stopping {
+		s.stopping = true
+		close(s.stop)
+	}
+	instance := s.instance
+	s.mu.Unlock()
+
+	var e error
+
+	select {
+	case <-instance.Done():
+		// crashed and waiting for a restart, nothing to stop
+	default:
+		e = instance.Stop(ctx, mode)
+	}
+
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return e
+}
+
+// Done is closed once the supervisor has stopped or given up.
+func (s *Supervisor) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the supervisor gave up, nil otherwise.
+func (s *Supervisor) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
@@ -0,0 +1,387 @@
+package gpgsql
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStarter stands in for Daemon with sleep processes, so the
+// restart logic runs without postgres.
+type fakeStarter struct {
+	t    *testing.T
+	fail func(n int) error // fails the nth start when it returns an error
+
+	mu        sync.Mutex
+	starts    []time.Time
+	instances []*Instance
+}
+
+func newFakeStarter(t *testing.T, fail func(n int) error) *fakeStarter {
+	t.Helper()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("stands in for postgres with sleep")
+	}
+
+	f := &fakeStarter{t: t, fail: fail}
+
+	t.Cleanup(func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		for _, i := range f.instances {
+			i.Stop(context.Background(), ShutdownImmediate)
+		}
+	})
+
+	return f
+}
+
+func (f *fakeStarter) start(ctx context.Context) (*Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.starts = append(f.starts, time.Now())
+
+	if f.fail != nil {
+		if e := f.fail(len(f.starts)); e != nil {
+			return nil, e
+		}
+	}
+
+	g := &GpgsqlRuntime{}
+
+	p, e := g.startProcess(exec.Command("sleep", "60"), nil)
+	if e != nil {
+		return nil, e
+	}
+
+	i := g.newProcessInstance(p)
+	f.instances = append(f.instances, i)
+
+	return i, nil
+}
+
+// gaps returns the time between consecutive starts.
+func (f *fakeStarter) gaps() []time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	gaps := []time.Duration{}
+	for n := 1; n < len(f.starts); n++ {
+		gaps = append(gaps, f.starts[n].Sub(f.starts[n-1]))
+	}
+
+	return gaps
+}
+
+// crash kills the process of i like a crashed postmaster.
+func crash(t *testing.T, i *Instance) {
+	t.Helper()
+
+	if e := i.proc.cmd.Process.Signal(os.Kill); e != nil {
+		t.Fatal(e)
+	}
+}
+
+// nextEvent waits for the next supervisor event.
+func nextEvent(t *testing.T, events <-chan SupervisorEvent) SupervisorEvent {
+	t.Helper()
+
+	select {
+	case evt := <-events:
+		return evt
+	case <-time.After(10 * time.Second):
+		t.Fatal("no supervisor event")
+	}
+
+	return SupervisorEvent{}
+}
+
+func expectEvent(t *testing.T, events <-chan SupervisorEvent, typ SupervisorEventType, restarts uint) SupervisorEvent {
+	t.Helper()
+
+	evt := nextEvent(t, events)
+	if evt.Type != typ || evt.Restarts != restarts {
+		t.Fatalf("got %s after %d restarts, want %s after %d", evt.Type, evt.Restarts, typ, restarts)
+	}
+
+	return evt
+}
+
+func TestSuperviseBackoff(t *testing.T) {
+	f := newFakeStarter(t, nil)
+	events := make(chan SupervisorEvent, 64)
+
+	s, e := supervise(context.Background(), &SupervisorOptions{
+		MaxRestarts: 3,
+		MinBackoff:  50 * time.Millisecond,
+		MaxBackoff:  120 * time.Millisecond,
+		OnEvent:     func(evt SupervisorEvent) { events <- evt },
+	}, f.start)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	i := expectEvent(t, events, SupervisorStarted, 0).Instance
+
+	for n := uint(1); n <= 3; n++ {
+		crash(t, i)
+
+		if evt := expectEvent(t, events, SupervisorCrashed, n-1); evt.Err == nil {
+			t.Fatal("crash without error")
+		}
+
+		expectEvent(t, events, SupervisorRestarting, n)
+
+		i = expectEvent(t, events, SupervisorRestarted, n).Instance
+		if i != s.Instance() {
+			t.Fatal("Instance is not the restarted server")
+		}
+	}
+
+	// the budget is spent, the next crash is the last
+	crash(t, i)
+	expectEvent(t, events, SupervisorCrashed, 3)
+	expectEvent(t, events, SupervisorGaveUp, 3)
+
+	select {
+	case <-s.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Done not closed after giving up")
+	}
+
+	if e := s.Err(); e == nil || !strings.Contains(e.Error(), "gave up after 3 restarts") {
+		t.Fatalf("Err = %v", e)
+	}
+
+	// doubling from MinBackoff, capped at MaxBackoff
+	gaps := f.gaps()
+	for n, min := range []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 120 * time.Millisecond} {
+		if gaps[n] < min {
+			t.Errorf("restart %d after %s, want at least %s", n+1, gaps[n], min)
+		}
+	}
+}
+
+func TestSuperviseStartFailure(t *testing.T) {
+	broken := errors.New("could not create any TCP/IP sockets")
+
+	f := newFakeStarter(t, func(n int) error {
+		if n > 1 {
+			return broken
+		}
+
+		return nil
+	})
+
+	events := make(chan SupervisorEvent, 64)
+
+	s, e := supervise(context.Background(), &SupervisorOptions{
+		MaxRestarts: 2,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  time.Millisecond,
+		OnEvent:     func(evt SupervisorEvent) { events <- evt },
+	}, f.start)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	crash(t, expectEvent(t, events, SupervisorStarted, 0).Instance)
+	expectEvent(t, events, SupervisorCrashed, 0)
+	expectEvent(t, events, SupervisorRestarting, 1)
+
+	// failed starts use up the budget as well
+	if evt := expectEvent(t, events, SupervisorRestarting, 2); !errors.Is(evt.Err, broken) {
+		t.Fatalf("got %v, want the start error", evt.Err)
+	}
+
+	expectEvent(t, events, SupervisorGaveUp, 2)
+	<-s.Done()
+
+	if e := s.Err(); e == nil || !strings.Contains(e.Error(), broken.Error()) {
+		t.Fatalf("Err = %v", e)
+	}
+
+	if _, e := supervise(context.Background(), &SupervisorOptions{}, f.start); !errors.Is(e, broken) {
+		t.Fatalf("first start gave %v, want %v", e, broken)
+	}
+}
+
+// a server that ran for ResetAfter gets a fresh budget
+func TestSuperviseResetAfter(t *testing.T) {
+	f := newFakeStarter(t, nil)
+	events := make(chan SupervisorEvent, 64)
+
+	s, e := supervise(context.Background(), &SupervisorOptions{
+		MaxRestarts: 1,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  time.Millisecond,
+		ResetAfter:  50 * time.Millisecond,
+		OnEvent:     func(evt SupervisorEvent) { events <- evt },
+	}, f.start)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Stop(context.Background(), ShutdownFast)
+
+	i := expectEvent(t, events, SupervisorStarted, 0).Instance
+
+	for n := 0; n < 3; n++ {
+		time.Sleep(100 * time.Millisecond)
+		crash(t, i)
+
+		// reported with the restarts so far, the budget resets after
+		expectEvent(t, events, SupervisorCrashed, uint(min(n, 1)))
+		expectEvent(t, events, SupervisorRestarting, 1)
+		i = expectEvent(t, events, SupervisorRestarted, 1).Instance
+	}
+}
+
+func TestSuperviseStop(t *testing.T) {
+	t.Run("running", func(t *testing.T) {
+		f := newFakeStarter(t, nil)
+		events := make(chan SupervisorEvent, 64)
+
+		s, e := supervise(context.Background(), &SupervisorOptions{
+			MinBackoff: time.Millisecond,
+			MaxBackoff: time.Millisecond,
+			OnEvent:    func(evt SupervisorEvent) { events <- evt },
+		}, f.start)
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		i := expectEvent(t, events, SupervisorStarted, 0).Instance
+
+		// sleep exits on the fast shutdown signal
+		s.Stop(context.Background(), ShutdownFast)
+		expectEvent(t, events, SupervisorStopped, 0)
+
+		select {
+		case <-i.Done():
+		default:
+			t.Fatal("server still running after Stop")
+		}
+
+		if s.Err() != nil {
+			t.Fatalf("Err = %v", s.Err())
+		}
+	})
+
+	t.Run("backoff", func(t *testing.T) {
+		f := newFakeStarter(t, nil)
+		events := make(chan SupervisorEvent, 64)
+
+		s, e := supervise(context.Background(), &SupervisorOptions{
+			MinBackoff: time.Hour,
+			MaxBackoff: time.Hour,
+			OnEvent:    func(evt SupervisorEvent) { events <- evt },
+		}, f.start)
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		crash(t, expectEvent(t, events, SupervisorStarted, 0).Instance)
+		expectEvent(t, events, SupervisorCrashed, 0)
+		expectEvent(t, events, SupervisorRestarting, 1)
+
+		// does not wait for the restart
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		s.Stop(ctx, ShutdownFast)
+		expectEvent(t, events, SupervisorStopped, 1)
+
+		if len(f.gaps()) > 0 {
+			t.Fatal("restarted after Stop")
+		}
+	})
+
+	t.Run("context", func(t *testing.T) {
+		f := newFakeStarter(t, nil)
+		events := make(chan SupervisorEvent, 64)
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		s, e := supervise(ctx, &SupervisorOptions{
+			MinBackoff: time.Hour,
+			MaxBackoff: time.Hour,
+			OnEvent:    func(evt SupervisorEvent) { events <- evt },
+		}, f.start)
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		crash(t, expectEvent(t, events, SupervisorStarted, 0).Instance)
+		expectEvent(t, events, SupervisorCrashed, 0)
+		expectEvent(t, events, SupervisorRestarting, 1)
+
+		cancel()
+		expectEvent(t, events, SupervisorStopped, 1)
+		<-s.Done()
+	})
+}
+
+// a killed postmaster comes back on the same port and data directory
+func TestSupervise(t *testing.T) {
+	testRuntime(t)
+
+	g, e := Ephemeral()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	t.Cleanup(func() { g.Cleanup() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	if e := g.Initdb(ctx, &InitdbOptions{Encoding: "UTF8", NoLocale: true, AuthMethod: "trust"}); e != nil {
+		t.Fatal(e)
+	}
+
+	events := make(chan SupervisorEvent, 64)
+
+	s, e := g.Supervise(ctx, &SupervisorOptions{
+		MaxRestarts: 3,
+		MinBackoff:  100 * time.Millisecond,
+		OnEvent:     func(evt SupervisorEvent) { events <- evt },
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Stop(context.Background(), ShutdownFast)
+
+	first := expectEvent(t, events, SupervisorStarted, 0).Instance
+
+	p, e := os.FindProcess(first.PID())
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if e := p.Kill(); e != nil {
+		t.Fatal(e)
+	}
+
+	expectEvent(t, events, SupervisorCrashed, 0)
+	expectEvent(t, events, SupervisorRestarting, 1)
+
+	second := expectEvent(t, events, SupervisorRestarted, 1).Instance
+
+	if second.PID() == first.PID() || second.ListenAddr() != first.ListenAddr() {
+		t.Fatalf("restarted as pid %d on %s, was pid %d on %s",
+			second.PID(), second.ListenAddr(), first.PID(), first.ListenAddr())
+	}
+
+	if e := g.CheckConnection(ctx); e != nil {
+		t.Fatalf("restarted server: %s", e.Error())
+	}
+}
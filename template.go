@@ -0,0 +1,203 @@
+package gpgsql
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// pristine clusters, in the cache directory
+	templateDirName = "templates"
+)
+
+var (
+	// makes copy-on-write clones, tests replace it to force plain copies
+	fileCloner = cloneFile
+)
+
+// templateKey identifies the cluster initdb creates for opt,
+// the password is part of it since initdb stores it in the cluster.
+func (g *GpgsqlRuntime) templateKey(opt *InitdbOptions) string {
+	h := sha256.New()
+
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00%t\x00%s\x00%s\x00%t\x00%s",
+		g.version, g.binaryDir, g.username, g.password,
+		opt.Encoding, opt.NoLocale, opt.Locale, opt.AuthMethod,
+		opt.DataChecksums, opt.TextSearchConfig)
+
+	for _, arg := range opt.Args {
+		fmt.Fprintf(h, "\x00%s", arg)
+	}
+
+	return fmt.Sprintf("%s_%x", g.version, h.Sum(nil)[:8])
+}
+
+// InitdbFromTemplate fills the empty data directory with a copy of a
+// cached cluster initialized with the same options, the cache entry is
+// created by initdb the first time. Copies use reflinks where the
+// filesystem supports them. Hardlinks are never used, postgres
+// rewrites relation files in place and would corrupt the template.
+func (g *GpgsqlRuntime) InitdbFromTemplate(ctx context.Context, opts ...*InitdbOptions) error {
+	if len(opts) < 1 || opts[0] == nil {
+		opts = append(opts[:0], defaultInitdbOptions)
+	}
+
+	opt := opts[0]
+
+	info, e := g.InspectData()
+	if e != nil {
+		return fmt.Errorf("failed to inspect data directory: %s", e.Error())
+	}
+
+	if info.State != DataEmpty && info.State != DataMissing {
+		return fmt.Errorf("data directory is not empty: %s", info.State)
+	}
+
+	template, e := g.template(ctx, opt)
+	if e != nil {
+		return e
+	}
+
+	if e := copyTree(template, g.data); e != nil {
+		return fmt.Errorf("failed to copy template: %s", e.Error())
+	}
+
+	return nil
+}
+
+// template returns the cached cluster for opt, running initdb into a
+// temp directory and renaming it into place when it does not exist.
+func (g *GpgsqlRuntime) template(ctx context.Context, opt *InitdbOptions) (string, error) {
+	key := g.templateKey(opt)
+	root := filepath.Join(g.cacheDir, templateDirName)
+	dir := filepath.Join(root, key)
+
+	if f, _ := os.Stat(dir); f != nil && f.IsDir() {
+		return dir, nil
+	}
+
+	if e := os.MkdirAll(root, os.ModePerm); e != nil {
+		return "", fmt.Errorf("failed to create template root: %s", e.Error())
+	}
+
+	tmp, e := os.MkdirTemp(root, key+".tmp-*")
+	if e != nil {
+		return "", fmt.Errorf("failed to create template directory: %s", e.Error())
+	}
+
+	defer os.RemoveAll(tmp)
+
+	if e := os.Chmod(tmp, PostgresqlDataPerm); e != nil {
+		return "", e
+	}
+
+	t := &GpgsqlRuntime{
+		username:  g.username,
+		password:  g.password,
+		data:      tmp,
+		logger:    g.logger,
+		binaryDir: g.binaryDir,
+		cacheDir:  g.cacheDir,
+		version:   g.version,
+	}
+
+	if e := t.Initdb(ctx, opt); e != nil {
+		return "", fmt.Errorf("failed to initdb template: %w", e)
+	}
+
+	if e := os.Rename(tmp, dir); e != nil {
+		// another process created the same template first
+		if f, _ := os.Stat(dir); f != nil && f.IsDir() {
+			return dir, nil
+		}
+
+		return "", fmt.Errorf("failed to move template into place: %s", e.Error())
+	}
+
+	return dir, nil
+}
+
+// CleanTemplates removes every cached cluster template of the default
+// cache directory.
+func CleanTemplates() error {
+	return os.RemoveAll(filepath.Join(cacheRoot(), templateDirName))
+}
+
+// CleanTemplates removes every cached cluster template of the cache
+// directory of g.
+func (g *GpgsqlRuntime) CleanTemplates() error {
+	return os.RemoveAll(filepath.Join(g.cacheDir, templateDirName))
+}
+
+// copyTree copies the directory src into dst, keeping permissions.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, e error) error {
+		if e != nil {
+			return e
+		}
+
+		rel, e := filepath.Rel(src, path)
+		if e != nil {
+			return e
+		}
+
+		target := filepath.Join(dst, rel)
+
+		info, e := d.Info()
+		if e != nil {
+			return e
+		}
+
+		switch {
+		case d.IsDir():
+			if e := os.MkdirAll(target, info.Mode().Perm()); e != nil {
+				return e
+			}
+
+			return os.Chmod(target, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			link, e := os.Readlink(path)
+			if e != nil {
+				return e
+			}
+
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		}
+
+		return fmt.Errorf("unsupported file type: %s", path)
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) (e error) {
+	in, e := os.Open(src)
+	if e != nil {
+		return e
+	}
+	defer in.Close()
+
+	out, e := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if e != nil {
+		return e
+	}
+
+	defer func() {
+		if ce := out.Close(); e == nil {
+			e = ce
+		}
+	}()
+
+	// fall back to a plain copy when the filesystem can't clone
+	if fileCloner(out, in) == nil {
+		return nil
+	}
+
+	_, e = io.Copy(out, in)
+	return e
+}
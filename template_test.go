@@ -0,0 +1,128 @@
+package gpgsql
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestTemplateKey(t *testing.T) {
+	base := func() (*GpgsqlRuntime, *InitdbOptions) {
+		return &GpgsqlRuntime{version: "14.5", binaryDir: "/bin", username: "postgres"},
+			&InitdbOptions{Encoding: "UTF8", Locale: "C", AuthMethod: "trust"}
+	}
+
+	g, opt := base()
+	key := g.templateKey(opt)
+
+	if g, opt := base(); g.templateKey(opt) != key {
+		t.Fatal("same options gave different keys")
+	}
+
+	keys := map[string]string{"base": key}
+
+	for name, change := range map[string]func(g *GpgsqlRuntime, opt *InitdbOptions){
+		"version":  func(g *GpgsqlRuntime, opt *InitdbOptions) { g.version = "15.0" },
+		"encoding": func(g *GpgsqlRuntime, opt *InitdbOptions) { opt.Encoding = "LATIN1" },
+		"locale":   func(g *GpgsqlRuntime, opt *InitdbOptions) { opt.Locale = "en_US.UTF-8" },
+		"nolocale": func(g *GpgsqlRuntime, opt *InitdbOptions) { opt.Locale, opt.NoLocale = "", true },
+		"auth":     func(g *GpgsqlRuntime, opt *InitdbOptions) { opt.AuthMethod = "scram-sha-256" },
+		"username": func(g *GpgsqlRuntime, opt *InitdbOptions) { g.username = "admin" },
+		"password": func(g *GpgsqlRuntime, opt *InitdbOptions) { g.password = "secret" },
+		"args":     func(g *GpgsqlRuntime, opt *InitdbOptions) { opt.Args = []string{"--no-sync"} },
+	} {
+		g, opt := base()
+		change(g, opt)
+
+		k := g.templateKey(opt)
+
+		for other, v := range keys {
+			if v == k {
+				t.Errorf("%s and %s share the key %s", name, other, k)
+			}
+		}
+
+		keys[name] = k
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	src := t.TempDir()
+
+	for name, perm := range map[string]os.FileMode{
+		"PG_VERSION":          0600,
+		"base/1/1259":         0600,
+		"global/pg_control":   0640,
+		"postgresql.conf":     0600,
+		"pg_wal/000000010000": 0600,
+	} {
+		path := filepath.Join(src, name)
+
+		if e := os.MkdirAll(filepath.Dir(path), 0700); e != nil {
+			t.Fatal(e)
+		}
+
+		if e := os.WriteFile(path, []byte(name), perm); e != nil {
+			t.Fatal(e)
+		}
+
+		if e := os.Chmod(path, perm); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	if runtime.GOOS != "windows" {
+		if e := os.Symlink("base", filepath.Join(src, "link")); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	for _, c := range []struct {
+		name   string
+		cloner func(dst, src *os.File) error
+	}{
+		{"clone", cloneFile},
+		// filesystems without reflinks
+		{"fallback", func(dst, src *os.File) error { return errors.New("not supported") }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			defer func(cloner func(dst, src *os.File) error) { fileCloner = cloner }(fileCloner)
+			fileCloner = c.cloner
+
+			dst := filepath.Join(t.TempDir(), "data")
+
+			if e := copyTree(src, dst); e != nil {
+				t.Fatal(e)
+			}
+
+			if e := filepath.Walk(src, func(path string, info os.FileInfo, e error) error {
+				if e != nil {
+					return e
+				}
+
+				rel, _ := filepath.Rel(src, path)
+
+				copied, e := os.Lstat(filepath.Join(dst, rel))
+				if e != nil {
+					return e
+				}
+
+				if copied.Mode() != info.Mode() {
+					t.Errorf("%s is %v, want %v", rel, copied.Mode(), info.Mode())
+				}
+
+				if info.Mode().IsRegular() {
+					if b, e := os.ReadFile(filepath.Join(dst, rel)); e != nil || string(b) != rel {
+						t.Errorf("%s holds %q: %v", rel, b, e)
+					}
+				}
+
+				return nil
+			}); e != nil {
+				t.Fatal(e)
+			}
+		})
+	}
+}
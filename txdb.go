@@ -0,0 +1,726 @@
+package gpgsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// TxDriverName is the database/sql driver that runs every *sql.DB
+	// opened with it inside one transaction rolled back on Close.
+	TxDriverName = "gpgsql-tx"
+
+	// savepoint around single statements outside nested transactions
+	statementSavepoint = "gpgsql_statement"
+)
+
+type txStatementKind uint8
+
+const (
+	txStatementNone txStatementKind = iota
+	txStatementBegin
+	txStatementCommit
+	txStatementRollback
+)
+
+var (
+	ErrTxControl = errors.New("transaction control would end the gpgsql-tx transaction")
+
+	txDriverInstance = &txDriver{}
+)
+
+func init() {
+	sql.Register(TxDriverName, txDriverInstance)
+}
+
+// TxDB opens dbname through TxDriverName. Everything done through the
+// returned *sql.DB is rolled back when it is closed.
+func (g *GpgsqlRuntime) TxDB(dbname string) (*sql.DB, error) {
+	return sql.Open(TxDriverName, g.DSN(dbname))
+}
+
+// txDriver hands out one connector per sql.Open, the connector owns
+// the physical connection and the outer transaction.
+type txDriver struct{}
+
+func (d *txDriver) Open(dsn string) (driver.Conn, error) {
+	return nil, errors.New("gpgsql-tx connections are shared per *sql.DB, open it with sql.Open")
+}
+
+func (d *txDriver) OpenConnector(dsn string) (driver.Connector, error) {
+	c, e := pq.NewConnector(dsn)
+	if e != nil {
+		return nil, e
+	}
+
+	return &txConnector{connector: c}, nil
+}
+
+// txDriverConn is what the pq connection provides.
+type txDriverConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.Pinger
+}
+
+// txConnector serializes every connection of one *sql.DB onto a single
+// postgres connection inside one transaction. Nested transactions, from
+// Begin or from raw BEGIN/COMMIT/ROLLBACK statements, are savepoints.
+type txConnector struct {
+	connector driver.Connector
+
+	mu         sync.Mutex
+	conn       txDriverConn
+	tx         driver.Tx
+	savepoints []string // open nested transactions, innermost last
+	seq        int
+	closed     bool
+}
+
+func (c *txConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, errors.New("transaction database is closed")
+	}
+
+	if c.conn != nil {
+		return &txConn{c: c}, nil
+	}
+
+	conn, e := c.connector.Connect(ctx)
+	if e != nil {
+		return nil, e
+	}
+
+	pc, ok := conn.(txDriverConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("unsupported connection type %T", conn)
+	}
+
+	tx, e := pc.BeginTx(ctx, driver.TxOptions{})
+	if e != nil {
+		pc.Close()
+		return nil, fmt.Errorf("failed to begin transaction: %s", e.Error())
+	}
+
+	c.conn, c.tx = pc, tx
+	return &txConn{c: c}, nil
+}
+
+func (c *txConnector) Driver() driver.Driver {
+	return txDriverInstance
+}
+
+// Close rolls back the outer transaction, database/sql calls it from
+// (*sql.DB).Close.
+func (c *txConnector) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	c.closed = true
+
+	if c.conn == nil {
+		return nil
+	}
+
+	e := c.tx.Rollback()
+	if ce := c.conn.Close(); e == nil {
+		e = ce
+	}
+
+	return e
+}
+
+func (c *txConnector) exec(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, driver.ErrBadConn
+	}
+
+	kind, e := parseTxStatement(query)
+	if e != nil {
+		return nil, e
+	}
+
+	if kind != txStatementNone {
+		return driver.RowsAffected(0), c.txStatement(ctx, kind)
+	}
+
+	var res driver.Result
+
+	e = c.isolated(ctx, func() (e error) {
+		res, e = c.conn.ExecContext(ctx, query, args)
+		return e
+	})
+
+	return res, e
+}
+
+func (c *txConnector) query(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, driver.ErrBadConn
+	}
+
+	kind, e := parseTxStatement(query)
+	if e != nil {
+		return nil, e
+	}
+
+	if kind != txStatementNone {
+		return &txRows{sets: []txResultSet{{}}}, c.txStatement(ctx, kind)
+	}
+
+	var rows *txRows
+
+	e = c.isolated(ctx, func() error {
+		r, e := c.conn.QueryContext(ctx, query, args)
+		if e != nil {
+			return e
+		}
+
+		rows, e = bufferRows(r)
+		return e
+	})
+
+	return rows, e
+}
+
+// isolated runs f inside a savepoint when no nested transaction is
+// open, so a failing statement does not abort the outer transaction,
+// the same way it would not affect later statements in autocommit.
+func (c *txConnector) isolated(ctx context.Context, f func() error) error {
+	if len(c.savepoints) > 0 {
+		return txError(f())
+	}
+
+	if _, e := c.conn.ExecContext(ctx, "SAVEPOINT "+statementSavepoint, nil); e != nil {
+		return txError(e)
+	}
+
+	if e := f(); e != nil {
+		c.conn.ExecContext(context.WithoutCancel(ctx), "ROLLBACK TO SAVEPOINT "+statementSavepoint, nil)
+		return txError(e)
+	}
+
+	_, e := c.conn.ExecContext(ctx, "RELEASE SAVEPOINT "+statementSavepoint, nil)
+	return txError(e)
+}
+
+// txStatement maps raw transaction statements onto savepoints, COMMIT
+// and ROLLBACK without an open nested transaction do nothing, like
+// postgres outside a transaction.
+func (c *txConnector) txStatement(ctx context.Context, kind txStatementKind) error {
+	if kind == txStatementBegin {
+		_, e := c.begin(ctx)
+		return e
+	}
+
+	if len(c.savepoints) < 1 {
+		return nil
+	}
+
+	return c.end(ctx, c.savepoints[len(c.savepoints)-1], kind == txStatementCommit)
+}
+
+// begin opens a nested transaction and returns its savepoint.
+func (c *txConnector) begin(ctx context.Context) (string, error) {
+	c.seq++
+	name := fmt.Sprintf("gpgsql_%d", c.seq)
+
+	if _, e := c.conn.ExecContext(ctx, "SAVEPOINT "+name, nil); e != nil {
+		return "", txError(e)
+	}
+
+	c.savepoints = append(c.savepoints, name)
+	return name, nil
+}
+
+// end commits or rolls back the nested transaction of savepoint name,
+// together with the ones opened inside it.
+func (c *txConnector) end(ctx context.Context, name string, commit bool) error {
+	i := len(c.savepoints) - 1
+	for i >= 0 && c.savepoints[i] != name {
+		i--
+	}
+
+	if i < 0 {
+		return sql.ErrTxDone
+	}
+
+	c.savepoints = c.savepoints[:i]
+
+	if !commit {
+		if _, e := c.conn.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name, nil); e != nil {
+			return txError(e)
+		}
+	}
+
+	_, e := c.conn.ExecContext(ctx, "RELEASE SAVEPOINT "+name, nil)
+	return txError(e)
+}
+
+// txError keeps database/sql from retrying on a new connection,
+// the outer transaction is gone with the broken one.
+func txError(e error) error {
+	if errors.Is(e, driver.ErrBadConn) {
+		return fmt.Errorf("transaction connection lost: %s", e.Error())
+	}
+
+	return e
+}
+
+// parseTxStatement recognizes statements that start or end a
+// transaction, ROLLBACK TO SAVEPOINT and the like are left alone.
+// Transaction control postgres would apply to the outer transaction
+// itself, like COMMIT AND CHAIN, PREPARE TRANSACTION or a COMMIT among
+// several statements of a simple query, is refused with ErrTxControl.
+func parseTxStatement(query string) (txStatementKind, error) {
+	statements := splitStatements(query)
+
+	if len(statements) == 1 {
+		kind, ok := txStatementOf(statements[0])
+		if !ok {
+			return txStatementNone, fmt.Errorf("%w: %s", ErrTxControl, statements[0])
+		}
+
+		return kind, nil
+	}
+
+	for _, statement := range statements {
+		if kind, ok := txStatementOf(statement); !ok || kind != txStatementNone {
+			return txStatementNone, fmt.Errorf("%w: %s among several statements", ErrTxControl, statement)
+		}
+	}
+
+	return txStatementNone, nil
+}
+
+// txStatementOf classifies a single statement, ok is false for
+// transaction control that can't be mapped onto a savepoint.
+func txStatementOf(statement string) (kind txStatementKind, ok bool) {
+	fields := strings.Fields(strings.ToUpper(statement))
+	if len(fields) < 1 {
+		return txStatementNone, true
+	}
+
+	rest := fields[1:]
+	if len(rest) > 0 && (rest[0] == "WORK" || rest[0] == "TRANSACTION") {
+		rest = rest[1:]
+	}
+
+	plain := len(rest) == 0 || strings.Join(rest, " ") == "AND NO CHAIN"
+
+	switch fields[0] {
+	case "BEGIN":
+		return txStatementBegin, true
+	case "START":
+		if len(fields) > 1 && fields[1] == "TRANSACTION" {
+			return txStatementBegin, true
+		}
+	case "COMMIT", "END":
+		if plain {
+			return txStatementCommit, true
+		}
+
+		return txStatementNone, false
+	case "ROLLBACK", "ABORT":
+		if plain {
+			return txStatementRollback, true
+		}
+
+		if fields[0] == "ROLLBACK" && len(rest) > 0 && rest[0] == "TO" {
+			return txStatementNone, true
+		}
+
+		return txStatementNone, false
+	case "PREPARE":
+		if len(fields) > 1 && fields[1] == "TRANSACTION" {
+			return txStatementNone, false
+		}
+	}
+
+	return txStatementNone, true
+}
+
+// splitStatements splits a simple query into its statements the way
+// postgres does, skipping semicolons in quotes and comments. Comments
+// are blanked out and empty statements dropped.
+func splitStatements(query string) []string {
+	var (
+		statements []string
+		statement  strings.Builder
+	)
+
+	flush := func() {
+		if s := strings.TrimSpace(statement.String()); s != "" {
+			statements = append(statements, s)
+		}
+
+		statement.Reset()
+	}
+
+	for i := 0; i < len(query); {
+		c := query[i]
+
+		switch {
+		case c == ';':
+			flush()
+			i++
+		case strings.HasPrefix(query[i:], "--"):
+			if j := strings.IndexByte(query[i:], '\n'); j < 0 {
+				i = len(query)
+			} else {
+				i += j
+			}
+
+			statement.WriteByte(' ')
+		case strings.HasPrefix(query[i:], "/*"):
+			i = commentEnd(query, i)
+			statement.WriteByte(' ')
+		case c == '\'' || c == '"':
+			// E'...' strings allow backslash escapes
+			escapes := c == '\'' && i > 0 && (query[i-1] == 'E' || query[i-1] == 'e') && (i < 2 || !isIdentByte(query[i-2]))
+
+			j := quoteEnd(query, i, escapes)
+			statement.WriteString(query[i:j])
+			i = j
+		case c == '$' && dollarTag(query, i) != "":
+			tag := dollarTag(query, i)
+
+			j := len(query)
+			if k := strings.Index(query[i+len(tag):], tag); k >= 0 {
+				j = i + len(tag) + k + len(tag)
+			}
+
+			statement.WriteString(query[i:j])
+			i = j
+		default:
+			statement.WriteByte(c)
+			i++
+		}
+	}
+
+	flush()
+	return statements
+}
+
+// commentEnd returns the end of the, possibly nested, block comment
+// starting at i.
+func commentEnd(query string, i int) int {
+	depth := 0
+
+	for i < len(query) {
+		switch {
+		case strings.HasPrefix(query[i:], "/*"):
+			depth++
+			i += 2
+		case strings.HasPrefix(query[i:], "*/"):
+			depth--
+			i += 2
+
+			if depth < 1 {
+				return i
+			}
+		default:
+			i++
+		}
+	}
+
+	return i
+}
+
+// quoteEnd returns the end of the quoted string or identifier starting
+// at i, doubled quotes don't end it.
+func quoteEnd(query string, i int, escapes bool) int {
+	q := query[i]
+
+	for j := i + 1; j < len(query); j++ {
+		switch {
+		case escapes && query[j] == '\\':
+			j++
+		case query[j] == q:
+			if j+1 < len(query) && query[j+1] == q {
+				j++
+				continue
+			}
+
+			return j + 1
+		}
+	}
+
+	return len(query)
+}
+
+// dollarTag returns the $tag$ of the dollar quoted string starting at
+// i, or "" when there is none, e.g. for the parameter $1.
+func dollarTag(query string, i int) string {
+	if i > 0 && isIdentByte(query[i-1]) {
+		return ""
+	}
+
+	j := i + 1
+	if j < len(query) && (query[j] == '_' || query[j] >= 0x80 || unicode.IsLetter(rune(query[j]))) {
+		for j < len(query) && query[j] != '$' && isIdentByte(query[j]) {
+			j++
+		}
+	}
+
+	if j < len(query) && query[j] == '$' {
+		return query[i : j+1]
+	}
+
+	return ""
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))
+}
+
+// txConn is what database/sql sees as a connection, every one of them
+// shares the connector's postgres connection.
+type txConn struct {
+	c *txConnector
+}
+
+func (c *txConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+// PrepareContext defers to execution time, statements can't outlive
+// the savepoint they would be prepared in.
+func (c *txConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return &txStmt{c: c.c, query: query}, nil
+}
+
+func (c *txConn) Close() error {
+	return nil
+}
+
+func (c *txConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx opens a savepoint, isolation level and read only can't be
+// changed inside the outer transaction and are ignored.
+func (c *txConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.c.mu.Lock()
+	defer c.c.mu.Unlock()
+
+	if c.c.closed {
+		return nil, driver.ErrBadConn
+	}
+
+	name, e := c.c.begin(ctx)
+	if e != nil {
+		return nil, e
+	}
+
+	return &txTx{c: c.c, savepoint: name}, nil
+}
+
+func (c *txConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.c.exec(ctx, query, args)
+}
+
+func (c *txConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.c.query(ctx, query, args)
+}
+
+func (c *txConn) Ping(ctx context.Context) error {
+	c.c.mu.Lock()
+	defer c.c.mu.Unlock()
+
+	if c.c.closed {
+		return driver.ErrBadConn
+	}
+
+	return txError(c.c.conn.Ping(ctx))
+}
+
+type txTx struct {
+	c         *txConnector
+	savepoint string
+}
+
+func (t *txTx) Commit() error {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+
+	return t.c.end(context.Background(), t.savepoint, true)
+}
+
+func (t *txTx) Rollback() error {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+
+	return t.c.end(context.Background(), t.savepoint, false)
+}
+
+type txStmt struct {
+	c     *txConnector
+	query string
+}
+
+func (s *txStmt) Close() error {
+	return nil
+}
+
+func (s *txStmt) NumInput() int {
+	return -1
+}
+
+func (s *txStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *txStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *txStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.c.exec(ctx, s.query, args)
+}
+
+func (s *txStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.c.query(ctx, s.query, args)
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+
+	return named
+}
+
+// txRows are read completely before the query returns, so the shared
+// connection is free again while the caller iterates, e.g. to run
+// statements for every row.
+type txRows struct {
+	sets []txResultSet
+	set  int
+	row  int
+}
+
+type txResultSet struct {
+	columns []string
+	types   []string
+	rows    [][]driver.Value
+}
+
+func bufferRows(r driver.Rows) (*txRows, error) {
+	defer r.Close()
+
+	rows := &txRows{}
+
+	for {
+		set := txResultSet{columns: r.Columns()}
+
+		if t, ok := r.(driver.RowsColumnTypeDatabaseTypeName); ok {
+			for i := range set.columns {
+				set.types = append(set.types, t.ColumnTypeDatabaseTypeName(i))
+			}
+		}
+
+		for {
+			dest := make([]driver.Value, len(set.columns))
+
+			e := r.Next(dest)
+			if errors.Is(e, io.EOF) {
+				break
+			}
+
+			if e != nil {
+				return nil, e
+			}
+
+			// the driver may reuse its read buffer
+			for i, v := range dest {
+				if b, ok := v.([]byte); ok {
+					dest[i] = append([]byte(nil), b...)
+				}
+			}
+
+			set.rows = append(set.rows, dest)
+		}
+
+		rows.sets = append(rows.sets, set)
+
+		next, ok := r.(driver.RowsNextResultSet)
+		if !ok || !next.HasNextResultSet() {
+			return rows, nil
+		}
+
+		if e := next.NextResultSet(); errors.Is(e, io.EOF) {
+			return rows, nil
+		} else if e != nil {
+			return nil, e
+		}
+	}
+}
+
+func (r *txRows) Columns() []string {
+	return r.sets[r.set].columns
+}
+
+func (r *txRows) Close() error {
+	return nil
+}
+
+func (r *txRows) Next(dest []driver.Value) error {
+	set := r.sets[r.set]
+	if r.row >= len(set.rows) {
+		return io.EOF
+	}
+
+	copy(dest, set.rows[r.row])
+	r.row++
+
+	return nil
+}
+
+func (r *txRows) HasNextResultSet() bool {
+	return r.set+1 < len(r.sets)
+}
+
+func (r *txRows) NextResultSet() error {
+	if !r.HasNextResultSet() {
+		return io.EOF
+	}
+
+	r.set, r.row = r.set+1, 0
+	return nil
+}
+
+func (r *txRows) ColumnTypeDatabaseTypeName(index int) string {
+	if types := r.sets[r.set].types; index < len(types) {
+		return types[index]
+	}
+
+	return ""
+}
@@ -0,0 +1,229 @@
+package gpgsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	for _, c := range []struct {
+		query string
+		want  []string
+	}{
+		{"SELECT 1", []string{"SELECT 1"}},
+		{" SELECT 1; ; SELECT 2 ;", []string{"SELECT 1", "SELECT 2"}},
+		{"SELECT ';' ; COMMIT", []string{"SELECT ';'", "COMMIT"}},
+		{`SELECT 'it''s;'`, []string{`SELECT 'it''s;'`}},
+		{`SELECT E'\';', 2`, []string{`SELECT E'\';', 2`}},
+		{`SELECT "a;""b"`, []string{`SELECT "a;""b"`}},
+		{"SELECT $$;$$, $x$ $$; $x$; COMMIT", []string{"SELECT $$;$$, $x$ $$; $x$", "COMMIT"}},
+		{"SELECT $1; COMMIT", []string{"SELECT $1", "COMMIT"}},
+		{"SELECT 1 -- ; COMMIT\n", []string{"SELECT 1"}},
+		{"/* /* ; */ ; */ COMMIT", []string{"COMMIT"}},
+	} {
+		if got := splitStatements(c.query); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("splitStatements(%q) = %q, want %q", c.query, got, c.want)
+		}
+	}
+}
+
+func TestParseTxStatement(t *testing.T) {
+	for _, c := range []struct {
+		query string
+		want  txStatementKind
+		err   bool
+	}{
+		{"SELECT 1", txStatementNone, false},
+		{"begin", txStatementBegin, false},
+		{"BEGIN ISOLATION LEVEL SERIALIZABLE;", txStatementBegin, false},
+		{"START TRANSACTION", txStatementBegin, false},
+		{"COMMIT", txStatementCommit, false},
+		{"end work", txStatementCommit, false},
+		{"COMMIT AND NO CHAIN", txStatementCommit, false},
+		{"ROLLBACK", txStatementRollback, false},
+		{"ABORT TRANSACTION", txStatementRollback, false},
+		{"/* done */ ROLLBACK;", txStatementRollback, false},
+		{"ROLLBACK TO SAVEPOINT a", txStatementNone, false},
+		{"ROLLBACK WORK TO a", txStatementNone, false},
+		{"SAVEPOINT a; RELEASE a", txStatementNone, false},
+		{"PREPARE q AS SELECT 1", txStatementNone, false},
+		{"SELECT 'COMMIT'; SELECT 2", txStatementNone, false},
+		{"COMMIT AND CHAIN", txStatementNone, true},
+		{"ROLLBACK AND CHAIN", txStatementNone, true},
+		{"PREPARE TRANSACTION 'x'", txStatementNone, true},
+		{"COMMIT PREPARED 'x'", txStatementNone, true},
+		{"INSERT INTO t VALUES (1); COMMIT", txStatementNone, true},
+		{"BEGIN; INSERT INTO t VALUES (1)", txStatementNone, true},
+		{"SELECT 1; end", txStatementNone, true},
+	} {
+		kind, e := parseTxStatement(c.query)
+
+		if c.err != (e != nil) || (e != nil && !errors.Is(e, ErrTxControl)) {
+			t.Errorf("parseTxStatement(%q) error = %v, want error %v", c.query, e, c.err)
+		}
+
+		if kind != c.want {
+			t.Errorf("parseTxStatement(%q) = %d, want %d", c.query, kind, c.want)
+		}
+	}
+}
+
+// testTxDB returns a *sql.DB of the gpgsql-tx driver on a table t, and
+// a plain *sql.DB to look from outside its transaction.
+func testTxDB(t *testing.T) (*sql.DB, *sql.DB) {
+	t.Helper()
+
+	g := testServer(t)
+
+	plain, e := g.DB(g.username)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	t.Cleanup(func() { plain.Close() })
+
+	if _, e := plain.Exec("CREATE TABLE t (id int PRIMARY KEY)"); e != nil {
+		t.Fatal(e)
+	}
+
+	db, e := g.TxDB(g.username)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	return db, plain
+}
+
+func countRows(t *testing.T, db *sql.DB) int {
+	t.Helper()
+
+	var n int
+	if e := db.QueryRow("SELECT count(*) FROM t").Scan(&n); e != nil {
+		t.Fatal(e)
+	}
+
+	return n
+}
+
+func TestTxDBRollbackOnClose(t *testing.T) {
+	db, plain := testTxDB(t)
+
+	if _, e := db.Exec("INSERT INTO t VALUES (1)"); e != nil {
+		t.Fatal(e)
+	}
+
+	if n := countRows(t, db); n != 1 {
+		t.Fatalf("%d rows inside the transaction, want 1", n)
+	}
+
+	if n := countRows(t, plain); n != 0 {
+		t.Fatalf("%d rows outside the transaction, want 0", n)
+	}
+
+	if e := db.Close(); e != nil {
+		t.Fatal(e)
+	}
+
+	if n := countRows(t, plain); n != 0 {
+		t.Fatalf("%d rows after Close, want 0", n)
+	}
+}
+
+func TestTxDBNestedBegin(t *testing.T) {
+	db, plain := testTxDB(t)
+
+	tx, e := db.Begin()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if _, e := tx.Exec("INSERT INTO t VALUES (1)"); e != nil {
+		t.Fatal(e)
+	}
+
+	if e := tx.Rollback(); e != nil {
+		t.Fatal(e)
+	}
+
+	if n := countRows(t, db); n != 0 {
+		t.Fatalf("%d rows after Rollback, want 0", n)
+	}
+
+	tx, e = db.Begin()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if _, e := tx.Exec("INSERT INTO t VALUES (2)"); e != nil {
+		t.Fatal(e)
+	}
+
+	if e := tx.Commit(); e != nil {
+		t.Fatal(e)
+	}
+
+	if n := countRows(t, db); n != 1 {
+		t.Fatalf("%d rows after Commit, want 1", n)
+	}
+
+	// committed into the outer transaction only
+	if n := countRows(t, plain); n != 0 {
+		t.Fatalf("%d rows outside the transaction, want 0", n)
+	}
+}
+
+func TestTxDBRawStatements(t *testing.T) {
+	db, plain := testTxDB(t)
+
+	for _, query := range []string{"BEGIN", "INSERT INTO t VALUES (1)", "ROLLBACK", "START TRANSACTION", "INSERT INTO t VALUES (2)", "COMMIT"} {
+		if _, e := db.Exec(query); e != nil {
+			t.Fatalf("%s: %s", query, e.Error())
+		}
+	}
+
+	var id int
+	if e := db.QueryRow("SELECT id FROM t").Scan(&id); e != nil || id != 2 {
+		t.Fatalf("got row %d: %v, want 2", id, e)
+	}
+
+	// COMMIT outside a nested transaction does nothing
+	if _, e := db.Exec("COMMIT"); e != nil {
+		t.Fatal(e)
+	}
+
+	for _, query := range []string{"INSERT INTO t VALUES (3); COMMIT", "COMMIT AND CHAIN", "PREPARE TRANSACTION 'gpgsql'"} {
+		if _, e := db.Exec(query); !errors.Is(e, ErrTxControl) {
+			t.Fatalf("%s: got %v, want %v", query, e, ErrTxControl)
+		}
+	}
+
+	if n := countRows(t, plain); n != 0 {
+		t.Fatalf("%d rows outside the transaction, want 0", n)
+	}
+}
+
+func TestTxDBFailingStatement(t *testing.T) {
+	db, _ := testTxDB(t)
+
+	if _, e := db.Exec("INSERT INTO t VALUES (1)"); e != nil {
+		t.Fatal(e)
+	}
+
+	if _, e := db.Exec("INSERT INTO t VALUES (1)"); e == nil {
+		t.Fatal("duplicate key did not fail")
+	}
+
+	// the outer transaction is not aborted
+	if _, e := db.ExecContext(context.Background(), "INSERT INTO t VALUES (2)"); e != nil {
+		t.Fatal(e)
+	}
+
+	if n := countRows(t, db); n != 2 {
+		t.Fatalf("%d rows, want 2", n)
+	}
+}
@@ -9,10 +9,12 @@ import (
 	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 
 	"github.com/ClarkQAQ/gpgsql/release"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 const (
@@ -39,6 +41,17 @@ func ReleaseArchive() []byte {
 	return release.Archive
 }
 
+// AvailableVersions returns the embedded postgres versions, newest
+// first, for RuntimeOptions.Version.
+func AvailableVersions() []string {
+	versions := []string{}
+	for _, r := range release.Releases() {
+		versions = append(versions, r.Version)
+	}
+
+	return versions
+}
+
 type HookWriter struct {
 	w    io.Writer
 	hook func(p []byte)
@@ -70,7 +83,7 @@ func (w *HookWriter) Error() error {
 		return nil
 	}
 
-	return errors.New(w.buf.String())
+	return ClassifyOutput(w.buf.String())
 }
 
 func (w *HookWriter) Hook(f func(p []byte)) {
@@ -102,7 +115,13 @@ func (g *GpgsqlRuntime) CheckConnection(ctx context.Context) error {
 
 	defer db.Close()
 
-	if _, e = db.QueryContext(ctx, "SELECT 1"); e != nil {
+	var one int
+	if e := db.QueryRowContext(ctx, "SELECT 1").Scan(&one); e != nil {
+		var pqErr *pq.Error
+		if errors.As(e, &pqErr) && pqErr.Code.Class() == "28" {
+			return &OutputError{Err: ErrAuthentication, Output: e.Error()}
+		}
+
 		return e
 	}
 
@@ -110,8 +129,26 @@ func (g *GpgsqlRuntime) CheckConnection(ctx context.Context) error {
 }
 
 func (g *GpgsqlRuntime) DSN(dbname string) string {
+	return dsn(g.host, g.socket, g.port, g.username, g.password, dbname)
+}
+
+// dsn connects through the unix socket directory when host is nil.
+func dsn(host net.IP, socket string, port uint16, username, password, dbname string) string {
+	h := host.String()
+	if host == nil && socket != "" {
+		h = socket
+	}
+
 	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		g.host.String(), g.port, g.username, g.password, dbname)
+		h, port, username, password, dbname)
+}
+
+func listenAddr(host net.IP, socket string, port uint16) string {
+	if host == nil && socket != "" {
+		return filepath.Join(socket, fmt.Sprintf(".s.PGSQL.%d", port))
+	}
+
+	return net.JoinHostPort(host.String(), strconv.Itoa(int(port)))
 }
 
 func (g *GpgsqlRuntime) DB(dbname string) (*sql.DB, error) {
@@ -126,6 +163,11 @@ func (g *GpgsqlRuntime) GetPassword() string {
 	return g.password
 }
 
+// IsEmptyData reports whether the data directory exists and holds no
+// entry at all, not even a .DS_Store. A missing directory is an error.
+//
+// Deprecated: use InspectData, which tells a missing directory from an
+// empty one and ignores the junk EnsureReady removes.
 func (g *GpgsqlRuntime) IsEmptyData() (bool, error) {
 	if f, e := os.Stat(g.data); e != nil {
 		return false, e